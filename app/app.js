@@ -162,6 +162,10 @@ async function uploadVideoFile(videoID) {
   uploadBtnSelector = 'upload-video-btn';
   setUploadButtonState(true, uploadBtnSelector);
 
+  // Start listening before the upload so no progress is missed. The video
+  // may still be ready from an earlier upload, that outcome isn't this one.
+  const progress = watchVideoProgress(videoID, { pending: true });
+
   try {
     const res = await fetch(`/api/video_upload/${videoID}`, {
       method: 'POST',
@@ -177,13 +181,68 @@ async function uploadVideoFile(videoID) {
 
     console.log('Video uploaded!');
     await getVideo(videoID);
+
+    const uploadBtn = document.getElementById(uploadBtnSelector);
+    uploadBtn.textContent = 'Processing...';
+    await progress.finished;
+    console.log('Video processed!');
+    if (currentVideo?.id === videoID) {
+      await getVideo(videoID);
+    }
   } catch (error) {
     alert(`Error: ${error.message}`);
   }
 
+  progress.close();
   setUploadButtonState(false, uploadBtnSelector);
 }
 
+const progressStageLabels = {
+  upload: 'Uploading',
+  processing: 'Processing',
+  storage: 'Storing',
+  transcode: 'Transcoding',
+  done: 'Done',
+  failed: 'Failed',
+};
+
+function watchVideoProgress(videoID, { pending = false } = {}) {
+  const progressBar = document.getElementById('video-progress');
+  const progressLabel = document.getElementById('video-progress-label');
+  progressBar.value = 0;
+  progressBar.style.display = 'block';
+  progressLabel.textContent = '';
+
+  const token = encodeURIComponent(localStorage.getItem('token'));
+  const pendingParam = pending ? '&pending=1' : '';
+  const source = new EventSource(`/api/videos/${videoID}/progress?token=${token}${pendingParam}`);
+
+  const finished = new Promise((resolve, reject) => {
+    source.addEventListener('progress', (event) => {
+      const data = JSON.parse(event.data);
+      progressBar.value = data.percent;
+      progressLabel.textContent = `${progressStageLabels[data.stage] || data.stage} ${Math.round(data.percent)}%`;
+
+      if (data.stage === 'done') {
+        source.close();
+        resolve();
+      } else if (data.stage === 'failed') {
+        source.close();
+        reject(new Error(data.message || 'Video processing failed.'));
+      }
+    });
+  });
+
+  return {
+    finished,
+    close() {
+      source.close();
+      progressBar.style.display = 'none';
+      progressLabel.textContent = '';
+    },
+  };
+}
+
 const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
@@ -262,6 +321,7 @@ function viewVideo(video) {
   } else {
     thumbnailImg.style.display = 'block';
     thumbnailImg.src = video.thumbnail_url;
+    thumbnailImg.srcset = srcsetFor(video.thumbnails && video.thumbnails.webp);
   }
 
   const videoPlayer = document.getElementById('video-player');
@@ -270,7 +330,9 @@ function viewVideo(video) {
       videoPlayer.style.display = 'none';
     } else {
       videoPlayer.style.display = 'block';
-      videoPlayer.src = video.video_url;
+      // Browsers with native HLS support get the adaptive bitrate ladder
+      const nativeHLS = videoPlayer.canPlayType('application/vnd.apple.mpegurl');
+      videoPlayer.src = video.manifest_url && nativeHLS ? video.manifest_url : video.video_url;
       videoPlayer.load();
     }
   }
@@ -299,3 +361,10 @@ async function deleteVideo() {
     alert(`Error: ${error.message}`);
   }
 }
+
+function srcsetFor(sizes) {
+  if (!sizes) return '';
+  return Object.entries(sizes)
+    .map(([descriptor, url]) => `${url} ${descriptor}`)
+    .join(', ');
+}
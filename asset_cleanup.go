@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+/*
+deleteAssetsPayload lists the stored files a delete_assets job removes.
+Prefixes cover everything processing writes next to a video's MP4, e.g.
+"landscape/abc123/" holds its HLS ladder, preview sprites and original.
+*/
+type deleteAssetsPayload struct {
+	VideoKeys     []string `json:"video_keys,omitempty"`
+	VideoPrefixes []string `json:"video_prefixes,omitempty"`
+	ThumbnailKeys []string `json:"thumbnail_keys,omitempty"`
+}
+
+func (p deleteAssetsPayload) empty() bool {
+	return len(p.VideoKeys) == 0 && len(p.VideoPrefixes) == 0 && len(p.ThumbnailKeys) == 0
+}
+
+func (p deleteAssetsPayload) merge(other deleteAssetsPayload) deleteAssetsPayload {
+	p.VideoKeys = append(p.VideoKeys, other.VideoKeys...)
+	p.VideoPrefixes = append(p.VideoPrefixes, other.VideoPrefixes...)
+	p.ThumbnailKeys = append(p.ThumbnailKeys, other.ThumbnailKeys...)
+	return p
+}
+
+// videoAssets returns the video store files of a processed video.
+// Legacy rows holding full URLs are skipped, there's no key to delete.
+func videoAssets(video database.Video) deleteAssetsPayload {
+	var assets deleteAssetsPayload
+	if video.VideoURL == nil || *video.VideoURL == "" || isAbsoluteURL(*video.VideoURL) {
+		return assets
+	}
+	videoKey := *video.VideoURL
+	assets.VideoKeys = append(assets.VideoKeys, videoKey)
+	assets.VideoPrefixes = append(assets.VideoPrefixes, strings.TrimSuffix(videoKey, path.Ext(videoKey))+"/")
+	return assets
+}
+
+// thumbnailAssets returns the thumbnail store files of a video's thumbnail
+func thumbnailAssets(video database.Video) deleteAssetsPayload {
+	var assets deleteAssetsPayload
+	seen := map[string]bool{}
+	add := func(key string) {
+		if key == "" || isAbsoluteURL(key) || seen[key] {
+			return
+		}
+		seen[key] = true
+		assets.ThumbnailKeys = append(assets.ThumbnailKeys, key)
+	}
+	if video.ThumbnailURL != nil {
+		add(*video.ThumbnailURL)
+	}
+	for _, sizes := range video.Thumbnails {
+		for _, key := range sizes {
+			add(key)
+		}
+	}
+	return assets
+}
+
+/*
+scheduleAssetDeletion queues a job deleting assets that no row references
+anymore. Callers schedule it only once the change replacing or removing the
+assets is committed, so a failed update never loses the current files.
+*/
+func (cfg *apiConfig) scheduleAssetDeletion(videoID uuid.UUID, assets deleteAssetsPayload) error {
+	if assets.empty() {
+		return nil
+	}
+	_, err := cfg.enqueueJob(jobKindDeleteAssets, &videoID, assets)
+	return err
+}
+
+// runDeleteAssetsJob deletes the files listed in the job, files that are
+// already gone don't count as errors so a retried job can finish
+func (cfg *apiConfig) runDeleteAssetsJob(ctx context.Context, job database.Job) error {
+	var payload deleteAssetsPayload
+	err := json.Unmarshal([]byte(job.Payload), &payload)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, prefix := range payload.VideoPrefixes {
+		objects, err := cfg.videoStore.List(ctx, prefix)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("couldn't list %s: %w", prefix, err))
+			continue
+		}
+		for _, object := range objects {
+			errs = append(errs, deleteAsset(ctx, cfg.videoStore, object.Key))
+		}
+	}
+	for _, key := range payload.VideoKeys {
+		errs = append(errs, deleteAsset(ctx, cfg.videoStore, key))
+	}
+	for _, key := range payload.ThumbnailKeys {
+		errs = append(errs, deleteAsset(ctx, cfg.thumbnailStore, key))
+	}
+	return errors.Join(errs...)
+}
+
+func deleteAsset(ctx context.Context, store storage.BlobStore, key string) error {
+	err := store.Delete(ctx, key)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("couldn't delete %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// Storage backends selectable with VIDEO_STORAGE and THUMBNAIL_STORAGE
+const (
+	storageBackendS3     = "s3"
+	storageBackendLocal  = "local"
+	storageBackendMemory = "memory"
+)
+
+// URL modes selectable with VIDEO_URL_MODE and THUMBNAIL_URL_MODE
+const (
+	urlModeOrigin    = "origin"
+	urlModeS3        = "s3"
+	urlModeCDN       = "cdn"
+	urlModeLocal     = "local"
+	urlModePresign   = "presign"
+	urlModeCDNSigned = "cdn-signed"
+	urlModeCDNCookie = "cdn-cookie"
+)
+
+type blobStoreOptions struct {
+	s3Client   *s3.Client
+	s3Bucket   string
+	s3Region   string
+	multipart  storage.MultipartOptions
+	assetsRoot string
+	assetsURL  string
+	cdnDomain  string
+	presignTTL time.Duration
+
+	cfKeyPairID      string
+	cfPrivateKeyPath string
+	cfCookieDomain   string
+}
+
+/*
+newBlobStore creates the storage backend named by backend
+S3 stores use the configured bucket, local stores write below assetsRoot and
+are served from assetsURL, memory stores are meant for tests.
+*/
+func newBlobStore(backend string, opts blobStoreOptions) (storage.BlobStore, error) {
+	switch backend {
+	case storageBackendS3:
+		return storage.NewS3Store(opts.s3Client, opts.s3Bucket, opts.s3Region, opts.multipart), nil
+	case storageBackendLocal:
+		return storage.NewLocalStore(opts.assetsRoot, opts.assetsURL)
+	case storageBackendMemory:
+		return storage.NewMemoryStore(opts.assetsURL), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+/*
+newURLBuilder creates the URL builder named by mode
+The origin mode serves keys from whatever store holds them, the others
+rewrite them onto the S3 bucket, the CloudFront distribution or /assets.
+The presign mode signs a short-lived S3 URL on every request, which lets
+the bucket stay private. The cdn-signed and cdn-cookie modes do the same for
+a private CloudFront distribution, either with signed URLs or with signed
+cookies set when a single video is fetched.
+Stored rows only contain keys, so switching modes doesn't touch the database.
+*/
+func newURLBuilder(mode string, store storage.BlobStore, opts blobStoreOptions) (storage.URLBuilder, error) {
+	switch mode {
+	case urlModeOrigin:
+		return storage.OriginURLBuilder(store), nil
+	case urlModeS3:
+		return storage.NewBaseURLBuilder(storage.S3BaseURL(opts.s3Bucket, opts.s3Region)), nil
+	case urlModePresign:
+		if _, ok := store.(*storage.S3Store); !ok {
+			return nil, errors.New("presigned URLs require s3 storage")
+		}
+		return storage.NewPresignedURLBuilder(opts.s3Client, opts.s3Bucket, opts.presignTTL), nil
+	case urlModeCDNSigned, urlModeCDNCookie:
+		return newCloudFrontSigner(mode == urlModeCDNCookie, opts)
+	case urlModeCDN:
+		return storage.NewBaseURLBuilder(storage.CDNBaseURL(opts.cdnDomain)), nil
+	case urlModeLocal:
+		return storage.NewBaseURLBuilder(opts.assetsURL), nil
+	default:
+		return nil, fmt.Errorf("unknown URL mode %q", mode)
+	}
+}
+
+func newCloudFrontSigner(useCookies bool, opts blobStoreOptions) (*storage.CloudFrontSigner, error) {
+	if opts.cfKeyPairID == "" || opts.cfPrivateKeyPath == "" {
+		return nil, errors.New("signed CloudFront URLs require CF_KEY_PAIR_ID and CF_PRIVATE_KEY_PATH")
+	}
+	pemBytes, err := os.ReadFile(opts.cfPrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read CloudFront private key: %w", err)
+	}
+	privateKey, err := storage.ParseCloudFrontPrivateKey(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewCloudFrontSigner(storage.CloudFrontSignerOptions{
+		Domain:       opts.cdnDomain,
+		KeyPairID:    opts.cfKeyPairID,
+		PrivateKey:   privateKey,
+		TTL:          opts.presignTTL,
+		UseCookies:   useCookies,
+		CookieDomain: opts.cfCookieDomain,
+	}), nil
+}
+
+// randomAssetKey returns a random, URL safe key below prefix with the given extension, if any
+func randomAssetKey(prefix, extension string) (string, error) {
+	id := make([]byte, 32)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	name := base64.RawURLEncoding.EncodeToString(id)
+	if extension != "" {
+		name += "." + extension
+	}
+	return path.Join(prefix, name), nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	dashManifest     = "manifest.mpd"
+	dashManifestMIME = "application/dash+xml"
+	cmafSegmentMIME  = "video/iso.segment"
+	// The dash muxer names the HLS master playlist it writes next to the MPD
+	cmafHLSPlaylist = "master.m3u8"
+)
+
+/*
+packageCMAF uses ffmpeg to transcode a video into CMAF fragmented MP4
+renditions in outputDir, with a DASH manifest and an HLS master playlist
+that both reference the same segments. The ladder matches transcodeHLS.
+onProgress, if not nil, is called with the fraction of the video done.
+It returns the names of the MPD and the master playlist or an error if
+ffmpeg fails.
+*/
+func packageCMAF(ctx context.Context, media MediaProcessor, filePath, outputDir string, probe FFProbeOutput, onProgress func(float64)) (string, string, error) {
+	stream, ok := probe.videoStream()
+	displayWidth, displayHeight := stream.displaySize()
+	if !ok || displayWidth == 0 || displayHeight == 0 {
+		return "", "", fmt.Errorf("no video stream to package in %s", filePath)
+	}
+	duration := probe.duration()
+	frameRate := parseFrameRate(stream.AvgFrameRate)
+	ladder := hlsLadderFor(displayWidth, displayHeight)
+
+	args := []string{"-i", filePath}
+	for range ladder {
+		args = append(args, "-map", "0:v:0")
+	}
+	adaptationSets := "id=0,streams=v"
+	if probe.hasAudio() {
+		args = append(args, "-map", "0:a:0")
+		adaptationSets += " id=1,streams=a"
+	}
+
+	args = append(args,
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-profile:v", "main",
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsKeyframeSeconds),
+	)
+	for i, rendition := range ladder {
+		width, height := rendition.scaledSize(displayWidth, displayHeight)
+		args = append(args,
+			fmt.Sprintf("-filter:v:%d", i), fmt.Sprintf("scale=%d:%d", width, height),
+			fmt.Sprintf("-level:v:%d", i), h264LevelArg(rendition.level(displayWidth, displayHeight, frameRate)),
+			fmt.Sprintf("-b:v:%d", i), fmt.Sprintf("%dk", rendition.VideoBitrate),
+			fmt.Sprintf("-maxrate:v:%d", i), fmt.Sprintf("%dk", rendition.maxBitrate()),
+			fmt.Sprintf("-bufsize:v:%d", i), fmt.Sprintf("%dk", rendition.VideoBitrate*3/2),
+		)
+	}
+	if probe.hasAudio() {
+		args = append(args,
+			"-c:a", "aac",
+			"-b:a", fmt.Sprintf("%dk", ladder[0].AudioBitrate),
+			"-ac", "2",
+		)
+	}
+
+	args = append(args,
+		"-f", "dash",
+		"-seg_duration", fmt.Sprint(hlsSegmentSeconds),
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-adaptation_sets", adaptationSets,
+		"-init_seg_name", "init-$RepresentationID$.mp4",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		"-hls_playlist", "1",
+		"-hls_master_name", cmafHLSPlaylist,
+		filepath.Join(outputDir, dashManifest),
+	)
+
+	err := media.Run(ctx, args, func(done time.Duration) {
+		if onProgress != nil && duration > 0 {
+			onProgress(min(1, float64(done)/float64(duration)))
+		}
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't package CMAF renditions: %w", err)
+	}
+	return dashManifest, cmafHLSPlaylist, nil
+}
+
+// hasAudio reports whether the file has at least one audio stream
+func (p FFProbeOutput) hasAudio() bool {
+	for _, stream := range p.Streams {
+		if stream.CodecType == "audio" {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+processVideoCMAF packages a video as CMAF and uploads it below keyPrefix/cmaf,
+e.g. "landscape/abc123/cmaf/manifest.mpd"
+It returns the keys of the DASH manifest and the HLS master playlist.
+*/
+func (cfg *apiConfig) processVideoCMAF(ctx context.Context, ws *workspace, video database.Video, filePath string, probe FFProbeOutput, keyPrefix string) (string, string, error) {
+	outputDir, err := ws.mkdir("cmaf")
+	if err != nil {
+		return "", "", err
+	}
+
+	cfg.progress.publish(video.ID, progressEvent{Stage: progressStageTranscode})
+	manifest, playlist, err := packageCMAF(ctx, cfg.media, filePath, outputDir, probe, func(done float64) {
+		cfg.progress.publish(video.ID, progressEvent{Stage: progressStageTranscode, Percent: done * 100})
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	prefix := path.Join(keyPrefix, "cmaf")
+	err = cfg.putDirectory(ctx, outputDir, prefix)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't upload CMAF renditions: %w", err)
+	}
+	return path.Join(prefix, manifest), path.Join(prefix, playlist), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// diskFree isn't implemented here, scratch space checks are skipped
+func diskFree(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// Video store prefixes processed videos are written below, see orientation.go,
+// and staged uploads. A staged upload is referenced while a job processes it
+// and tus chunks while their upload is unfinished, ones abandoned by the
+// browser or left by a failed job are collected.
+var gcVideoPrefixes = []string{
+	directUploadPrefix + "/",
+	orientationLandscape + "/",
+	orientationPortrait + "/",
+	orientationSquare + "/",
+	orientationUltrawide + "/",
+	orientationOther + "/",
+}
+
+// gcReport sums up a garbage collection run
+type gcReport struct {
+	Scanned int
+	Orphans int
+	Bytes   int64
+	Deleted int
+	// Unreferenced files younger than the grace period
+	Recent int
+}
+
+/*
+assetReferences is the set of stored files the videos table points at.
+Every file below a video's key prefix belongs to it, e.g. its HLS ladder.
+Legacy rows hold full URLs, a file counts as referenced when its key is the
+tail of such a URL's path.
+*/
+type assetReferences struct {
+	keys     map[string]bool
+	prefixes []string
+}
+
+func newAssetReferences(videos []database.Video) assetReferences {
+	refs := assetReferences{keys: map[string]bool{}}
+	for _, video := range videos {
+		assets := videoAssets(video).merge(thumbnailAssets(video))
+		for _, key := range append(assets.VideoKeys, assets.ThumbnailKeys...) {
+			refs.keys[key] = true
+		}
+		refs.prefixes = append(refs.prefixes, assets.VideoPrefixes...)
+
+		for _, value := range []*string{
+			video.ThumbnailURL,
+			video.VideoURL,
+			video.ManifestURL,
+			video.DashManifestURL,
+			video.PreviewTrackURL,
+			video.OriginalURL,
+		} {
+			if value != nil {
+				refs.add(*value)
+			}
+		}
+		for _, sizes := range video.Thumbnails {
+			for _, value := range sizes {
+				refs.add(value)
+			}
+		}
+	}
+	return refs
+}
+
+func (r assetReferences) add(value string) {
+	if value == "" {
+		return
+	}
+	if !isAbsoluteURL(value) {
+		r.keys[value] = true
+		return
+	}
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return
+	}
+	// The key may sit below a bucket or /assets path segment, keep every tail
+	tail := strings.TrimPrefix(parsed.Path, "/")
+	for tail != "" {
+		r.keys[tail] = true
+		_, tail, _ = strings.Cut(tail, "/")
+	}
+}
+
+func (r assetReferences) has(key string) bool {
+	if r.keys[key] {
+		return true
+	}
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+collectGarbage finds stored files that no video references anymore and,
+unless dryRun is set, deletes them. Files modified within grace are left
+alone, processing uploads its files before the row points at them.
+It returns what it found, orphans are logged one per line.
+*/
+func (cfg *apiConfig) collectGarbage(ctx context.Context, dryRun bool, grace time.Duration) (gcReport, error) {
+	var report gcReport
+	if grace < jobTimeout {
+		return report, fmt.Errorf("grace period %s is shorter than the job timeout %s", grace, jobTimeout)
+	}
+
+	// Load the references before listing, anything stored after this is recent
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return report, fmt.Errorf("couldn't get videos: %w", err)
+	}
+	refs := newAssetReferences(videos)
+	jobs, err := cfg.db.GetUnfinishedJobs(jobKindProcessVideo)
+	if err != nil {
+		return report, fmt.Errorf("couldn't get jobs: %w", err)
+	}
+	for _, job := range jobs {
+		var payload processVideoPayload
+		if json.Unmarshal([]byte(job.Payload), &payload) == nil && payload.StagingKey != "" {
+			refs.keys[payload.StagingKey] = true
+		}
+	}
+	uploads, err := cfg.db.GetTusUploads()
+	if err != nil {
+		return report, fmt.Errorf("couldn't get tus uploads: %w", err)
+	}
+	for _, upload := range uploads {
+		refs.prefixes = append(refs.prefixes, tusChunkPrefix(upload))
+	}
+	cutoff := time.Now().Add(-grace)
+
+	collect := func(store storage.BlobStore, objects []storage.ObjectInfo) error {
+		for _, object := range objects {
+			report.Scanned++
+			if refs.has(object.Key) {
+				continue
+			}
+			if object.LastModified.After(cutoff) {
+				report.Recent++
+				continue
+			}
+			report.Orphans++
+			report.Bytes += object.Size
+			if dryRun {
+				log.Printf("Orphaned file %s (%d bytes, modified %s)", object.Key, object.Size, object.LastModified.Format(time.RFC3339))
+				continue
+			}
+			err := deleteAsset(ctx, store, object.Key)
+			if err != nil {
+				return err
+			}
+			log.Printf("Deleted orphaned file %s (%d bytes)", object.Key, object.Size)
+			report.Deleted++
+		}
+		return nil
+	}
+
+	for _, prefix := range gcVideoPrefixes {
+		objects, err := cfg.videoStore.List(ctx, prefix)
+		if err != nil {
+			return report, fmt.Errorf("couldn't list %s: %w", prefix, err)
+		}
+		err = collect(cfg.videoStore, objects)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	objects, err := cfg.thumbnailStore.List(ctx, "")
+	if err != nil {
+		return report, fmt.Errorf("couldn't list thumbnails: %w", err)
+	}
+	// Both stores may share the assets dir, videos are only collected above
+	thumbnails := []storage.ObjectInfo{}
+	for _, object := range objects {
+		if !isVideoStoreKey(object.Key) {
+			thumbnails = append(thumbnails, object)
+		}
+	}
+	err = collect(cfg.thumbnailStore, thumbnails)
+	if err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+func isVideoStoreKey(key string) bool {
+	for _, prefix := range gcVideoPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r gcReport) String() string {
+	return fmt.Sprintf("scanned %d files, %d orphaned (%d bytes), %d deleted, %d too recent to collect",
+		r.Scanned, r.Orphans, r.Bytes, r.Deleted, r.Recent)
+}
+
+// runGarbageCollection collects orphaned files every interval
+func (cfg *apiConfig) runGarbageCollection(interval, grace time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		report, err := cfg.collectGarbage(context.Background(), dryRun, grace)
+		if err != nil {
+			log.Printf("Couldn't collect orphaned files: %v", err)
+			continue
+		}
+		log.Printf("Garbage collection %s", report)
+	}
+}
+
+/*
+runGCCommand implements "tubely gc", a one off garbage collection run
+Flags default to the GC_* environment settings.
+It returns the process exit code.
+*/
+func (cfg *apiConfig) runGCCommand(args []string, grace time.Duration, dryRun bool) int {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	flags.BoolVar(&dryRun, "dry-run", dryRun, "only report orphaned files")
+	flags.DurationVar(&grace, "grace", grace, "leave files modified within this long alone")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	report, err := cfg.collectGarbage(context.Background(), dryRun, grace)
+	if err != nil {
+		log.Printf("Couldn't collect orphaned files: %v", err)
+		return 1
+	}
+	log.Printf("Garbage collection %s", report)
+	return 0
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+func TestCollectGarbageStagedUploads(t *testing.T) {
+	cfg := newTestConfig(t, nil)
+	root := t.TempDir()
+	store, err := storage.NewLocalStore(root, "http://localhost/assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.videoStore = store
+	video := newTestVideo(t, cfg)
+	ctx := context.Background()
+
+	prefix := directUploadPrefix + "/" + video.ID.String() + "/"
+	queued := prefix + "queued.mp4"
+	abandoned := prefix + "abandoned.mp4"
+	recent := prefix + "recent.mp4"
+	old := time.Now().Add(-3 * time.Hour)
+	for _, key := range []string{queued, abandoned, recent} {
+		err := store.Put(ctx, key, bytes.NewReader(mp4Head), "video/mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != recent {
+			err = os.Chtimes(filepath.Join(root, filepath.FromSlash(key)), old, old)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	_, err = cfg.enqueueJob(jobKindProcessVideo, &video.ID, processVideoPayload{StagingKey: queued})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := cfg.collectGarbage(ctx, true, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Orphans != 1 || report.Deleted != 0 || report.Recent != 1 {
+		t.Errorf("dry run report = %s, want the abandoned upload found and nothing deleted", report)
+	}
+
+	report, err = cfg.collectGarbage(ctx, false, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 1 {
+		t.Errorf("report = %s, want the abandoned upload deleted", report)
+	}
+	if _, err := store.Stat(ctx, abandoned); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("abandoned upload is still stored: %v", err)
+	}
+	for _, key := range []string{queued, recent} {
+		if _, err := store.Stat(ctx, key); err != nil {
+			t.Errorf("%s was collected: %v", key, err)
+		}
+	}
+}
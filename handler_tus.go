@@ -0,0 +1,571 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Resumable video uploads following the tus 1.0 protocol, with the creation,
+// termination and expiration extensions. See https://tus.io/protocols/resumable-upload
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+)
+
+// How long a PATCH holds an upload's lock without renewing it. It's renewed
+// while the PATCH runs, so this only delays uploads whose writer died.
+const tusLockLease = time.Minute
+
+/*
+Uploads can be resumed through any instance sharing the database. Chunks are
+stored in the video store below tusChunkPrefix, each named by the range of
+the upload it holds, and only the database row says how much arrived.
+*/
+func tusChunkPrefix(upload database.TusUpload) string {
+	return path.Join(directUploadPrefix, upload.VideoID.String(), "tus-"+upload.ID.String()) + "/"
+}
+
+func setTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// checkTusResumable rejects requests from clients speaking another tus version
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondWithError(w, http.StatusPreconditionFailed, "Unsupported tus version", nil)
+		return false
+	}
+	return true
+}
+
+func (cfg *apiConfig) handlerTusOptions(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxVideoUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+handlerTusCreate starts a resumable upload for a video the user owns
+The client sends the total size in Upload-Length and gets the upload's URL
+back in the Location header.
+*/
+func (cfg *apiConfig) handlerTusCreate(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	uploadLength, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || uploadLength <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Length", err)
+		return
+	}
+	if uploadLength > maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", nil)
+		return
+	}
+
+	dbVideo, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if dbVideo.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You don't own this video", nil)
+		return
+	}
+
+	// The finished upload is put together in the upload directory, make sure it fits
+	err = cfg.checkScratchSpace(uploadLength)
+	if errors.Is(err, errScratchFull) {
+		respondWithError(w, http.StatusInsufficientStorage, "Not enough space for the upload", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check free space", err)
+		return
+	}
+
+	upload, err := cfg.db.CreateTusUpload(database.CreateTusUploadParams{
+		VideoID:   videoID,
+		UserID:    userID,
+		Length:    uploadLength,
+		Metadata:  r.Header.Get("Upload-Metadata"),
+		ExpiresAt: time.Now().UTC().Add(cfg.tusExpiration),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/tus/"+upload.ID.String())
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// getTusUpload loads an upload and checks it belongs to the requesting user
+// and hasn't expired. It responds with an error itself when it returns false.
+func (cfg *apiConfig) getTusUpload(w http.ResponseWriter, r *http.Request) (database.TusUpload, bool) {
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", err)
+		return database.TusUpload{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.TusUpload{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.TusUpload{}, false
+	}
+
+	upload, err := cfg.db.GetTusUpload(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return database.TusUpload{}, false
+	}
+	if upload.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return database.TusUpload{}, false
+	}
+	if upload.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You don't own this upload", nil)
+		return database.TusUpload{}, false
+	}
+	if time.Now().UTC().After(upload.ExpiresAt) {
+		respondWithError(w, http.StatusGone, "Upload expired", nil)
+		return database.TusUpload{}, false
+	}
+	return upload, true
+}
+
+// handlerTusHead reports how much of an upload the server has received
+func (cfg *apiConfig) handlerTusHead(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	upload, ok := cfg.getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+handlerTusPatch appends a chunk to an upload at the offset the client claims
+Once the last byte arrives the file is queued for processing and the upload
+is removed.
+*/
+func (cfg *apiConfig) handlerTusPatch(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !checkTusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream", nil)
+		return
+	}
+
+	upload, ok := cfg.getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	// PATCHes of an upload may reach different instances, the lock in its
+	// row lets one of them write at a time
+	lock, err := cfg.lockTusUpload(upload.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't lock upload", err)
+		return
+	}
+	if lock == nil {
+		respondWithError(w, http.StatusConflict, "Upload is being written by another request", nil)
+		return
+	}
+	defer lock.release()
+
+	// Reload now that we hold the lock, another PATCH may have moved the offset
+	upload, err = cfg.db.GetTusUpload(upload.ID)
+	if err != nil || upload.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", err)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Offset", err)
+		return
+	}
+	if offset != upload.Offset {
+		respondWithError(w, http.StatusConflict, "Upload-Offset doesn't match", nil)
+		return
+	}
+
+	// Buffer the chunk on local disk before storing it
+	chunk, err := os.CreateTemp(cfg.tusDir, "tubely-tus-chunk-*")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't buffer chunk", err)
+		return
+	}
+	defer func() {
+		chunk.Close()
+		os.Remove(chunk.Name())
+	}()
+
+	// Keep whatever arrived even if the connection drops half way, the
+	// client resumes from the offset we save
+	body := newProgressReader(io.LimitReader(r.Body, upload.Length-upload.Offset), upload.Length, func(read, total int64) {
+		cfg.progress.publish(upload.VideoID, byteProgress(progressStageUpload, upload.Offset+read, total))
+	})
+	written, copyErr := io.Copy(cfg.newScratchWriter(chunk), body)
+	if written > 0 {
+		err = cfg.storeTusChunk(r.Context(), upload, chunk, written)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save chunk", err)
+			return
+		}
+		upload.Offset += written
+	}
+	upload.ExpiresAt = time.Now().UTC().Add(cfg.tusExpiration)
+	err = cfg.db.UpdateTusUploadOffset(upload.ID, lock.token, upload.Offset, upload.ExpiresAt)
+	if errors.Is(err, database.ErrTusUploadLockLost) {
+		respondWithError(w, http.StatusConflict, "Upload is being written by another request", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save upload offset", err)
+		return
+	}
+	if errors.Is(copyErr, errScratchFull) {
+		respondWithError(w, http.StatusInsufficientStorage, "Not enough space for the chunk", copyErr)
+		return
+	}
+	if copyErr != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save chunk", copyErr)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+
+	if upload.Offset < upload.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// The upload is complete, queue it like a regular upload
+	dbVideo, err := cfg.db.GetVideo(upload.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if dbVideo.UserID != upload.UserID {
+		respondWithError(w, http.StatusUnauthorized, "You don't own this video", nil)
+		return
+	}
+	// Another upload of the video may have been queued meanwhile, this one
+	// is kept so it can be completed again once that's done
+	started, err := cfg.db.StartVideoProcessing(dbVideo.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	if !started {
+		respondWithError(w, http.StatusConflict, "Video is already being processed", nil)
+		return
+	}
+	queued := false
+	defer func() {
+		if queued {
+			return
+		}
+		err := cfg.db.UpdateVideoStatus(dbVideo.ID, dbVideo.Status)
+		if err != nil {
+			log.Printf("Couldn't reset status of video %s: %v", dbVideo.ID, err)
+		}
+	}()
+
+	sourcePath, err := cfg.assembleTusUpload(r.Context(), upload)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't assemble upload", err)
+		return
+	}
+	// Remove the file on every way out unless the job took it over
+	defer func() {
+		if !queued {
+			os.Remove(sourcePath)
+		}
+	}()
+
+	contentType, err := cfg.validateVideoFile(r.Context(), sourcePath)
+	if err != nil {
+		// A finished upload that isn't a video can't be resumed into one
+		if errors.Is(err, errUnsupportedMedia) || errors.Is(err, errInvalidMedia) {
+			cfg.removeTusUpload(r.Context(), upload)
+		}
+		status, msg := mediaErrorStatus(err)
+		respondWithError(w, status, msg, err)
+		return
+	}
+	finalPath := sourcePath + "." + videoFormats[contentType]
+	err = os.Rename(sourcePath, finalPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save upload", err)
+		return
+	}
+	sourcePath = finalPath
+
+	_, err = cfg.enqueueVideoProcessing(r.Context(), dbVideo, processVideoPayload{
+		SourcePath: sourcePath,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+		return
+	}
+	queued = true
+
+	// The job is queued either way, chunks left behind expire with the upload
+	err = cfg.removeTusUpload(r.Context(), upload)
+	if err != nil {
+		log.Printf("Couldn't remove completed upload %s: %v", upload.ID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusUploadLock is a PATCH's hold on an upload, renewed until released
+type tusUploadLock struct {
+	cfg      *apiConfig
+	uploadID uuid.UUID
+	token    string
+	stop     chan struct{}
+}
+
+// lockTusUpload takes an upload's lock, it returns nil if another request
+// holds it
+func (cfg *apiConfig) lockTusUpload(uploadID uuid.UUID) (*tusUploadLock, error) {
+	lock := &tusUploadLock{cfg: cfg, uploadID: uploadID, token: uuid.NewString(), stop: make(chan struct{})}
+	now := time.Now().UTC()
+	locked, err := cfg.db.LockTusUpload(uploadID, lock.token, now, now.Add(tusLockLease))
+	if err != nil || !locked {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(tusLockLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lock.stop:
+				return
+			case <-ticker.C:
+			}
+			now := time.Now().UTC()
+			_, err := cfg.db.LockTusUpload(uploadID, lock.token, now, now.Add(tusLockLease))
+			if err != nil {
+				log.Printf("Couldn't renew lock of upload %s: %v", uploadID, err)
+			}
+		}
+	}()
+	return lock, nil
+}
+
+func (l *tusUploadLock) release() {
+	close(l.stop)
+	err := l.cfg.db.UnlockTusUpload(l.uploadID, l.token)
+	if err != nil {
+		log.Printf("Couldn't unlock upload %s: %v", l.uploadID, err)
+	}
+}
+
+// storeTusChunk stores the size bytes buffered in chunk as the part of the
+// upload starting at its current offset
+func (cfg *apiConfig) storeTusChunk(ctx context.Context, upload database.TusUpload, chunk *os.File, size int64) error {
+	_, err := chunk.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	key := tusChunkPrefix(upload) + fmt.Sprintf("%020d-%020d", upload.Offset, upload.Offset+size)
+	return cfg.videoStore.Put(ctx, key, io.LimitReader(chunk, size), "application/octet-stream")
+}
+
+/*
+assembleTusUpload joins the stored chunks of a finished upload into a file in
+the upload directory and returns its path. A PATCH whose lock expired may
+have left a chunk overlapping others, every chunk holds the same bytes of the
+upload's file, so the file is put together from whichever chunk reaches
+furthest at each point.
+*/
+func (cfg *apiConfig) assembleTusUpload(ctx context.Context, upload database.TusUpload) (string, error) {
+	objects, err := cfg.videoStore.List(ctx, tusChunkPrefix(upload))
+	if err != nil {
+		return "", err
+	}
+	type chunkRange struct {
+		key        string
+		start, end int64
+	}
+	chunks := []chunkRange{}
+	for _, object := range objects {
+		var c chunkRange
+		_, err := fmt.Sscanf(path.Base(object.Key), "%d-%d", &c.start, &c.end)
+		if err != nil || c.start >= c.end {
+			continue
+		}
+		c.key = object.Key
+		chunks = append(chunks, c)
+	}
+
+	file, err := os.CreateTemp(cfg.uploadDir, uploadPattern)
+	if err != nil {
+		return "", err
+	}
+	err = func() error {
+		defer file.Close()
+		for offset := int64(0); offset < upload.Length; {
+			next := chunkRange{end: offset}
+			for _, c := range chunks {
+				if c.start <= offset && c.end > next.end {
+					next = c
+				}
+			}
+			if next.key == "" {
+				return fmt.Errorf("upload %s has no chunk at offset %d", upload.ID, offset)
+			}
+			err := cfg.copyTusChunk(ctx, file, next.key, offset-next.start, next.end-offset)
+			if err != nil {
+				return err
+			}
+			offset = next.end
+		}
+		return nil
+	}()
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// copyTusChunk appends n bytes of a stored chunk, starting skip bytes in, to dst
+func (cfg *apiConfig) copyTusChunk(ctx context.Context, dst io.Writer, key string, skip, n int64) error {
+	body, err := cfg.videoStore.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.CopyN(io.Discard, body, skip)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(dst, body, n)
+	return err
+}
+
+// handlerTusDelete terminates an upload and frees its storage
+func (cfg *apiConfig) handlerTusDelete(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	upload, ok := cfg.getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	err := cfg.removeTusUpload(r.Context(), upload)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete upload", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeTusUpload deletes an upload's stored chunks and its row
+func (cfg *apiConfig) removeTusUpload(ctx context.Context, upload database.TusUpload) error {
+	chunks, err := cfg.videoStore.List(ctx, tusChunkPrefix(upload))
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		err := deleteAsset(ctx, cfg.videoStore, chunk.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return cfg.db.DeleteTusUpload(upload.ID)
+}
+
+// runTusExpiration removes expired uploads every interval
+func (cfg *apiConfig) runTusExpiration(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := cfg.expireTusUploads()
+		if err != nil {
+			log.Printf("Couldn't expire tus uploads: %v", err)
+		}
+	}
+}
+
+// expireTusUploads removes uploads that haven't received a chunk in time
+func (cfg *apiConfig) expireTusUploads() error {
+	uploads, err := cfg.db.GetExpiredTusUploads(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		err := cfg.removeTusUpload(context.Background(), upload)
+		if err != nil {
+			return fmt.Errorf("couldn't remove upload %s: %w", upload.ID, err)
+		}
+	}
+	return nil
+}
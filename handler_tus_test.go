@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// newTusRequest builds a tus request by the owner of video
+func newTusRequest(t *testing.T, cfg *apiConfig, video database.Video, method, target string, body []byte) *http.Request {
+	t.Helper()
+	token, err := auth.MakeJWT(video.UserID, cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	return r
+}
+
+func patchTusUpload(t *testing.T, cfg *apiConfig, video database.Video, uploadID string, offset int, chunk []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	r := newTusRequest(t, cfg, video, http.MethodPatch, "/api/tus/"+uploadID, chunk)
+	r.SetPathValue("uploadID", uploadID)
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	w := httptest.NewRecorder()
+	cfg.handlerTusPatch(w, r)
+	return w
+}
+
+// Two instances share the database and video store but not their disks,
+// an upload started on one can be resumed and completed on the other
+func TestTusUploadAcrossInstances(t *testing.T) {
+	first := newTestConfig(t, newFakeMediaProcessor(testProbe))
+	first.tusDir = t.TempDir()
+	first.tusExpiration = time.Hour
+	second := *first
+	second.tusDir = t.TempDir()
+	second.uploadDir = t.TempDir()
+	video := newTestVideo(t, first)
+	body := append(append([]byte(nil), mp4Head...), bytes.Repeat([]byte{1}, 1000)...)
+
+	r := newTusRequest(t, first, video, http.MethodPost, "/api/tus/videos/"+video.ID.String(), nil)
+	r.SetPathValue("videoID", video.ID.String())
+	r.Header.Set("Upload-Length", strconv.Itoa(len(body)))
+	w := httptest.NewRecorder()
+	first.handlerTusCreate(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", w.Code, w.Body)
+	}
+	uploadID := strings.TrimPrefix(w.Header().Get("Location"), "/api/tus/")
+
+	w = patchTusUpload(t, first, video, uploadID, 0, body[:600])
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "600" {
+		t.Fatalf("first PATCH = %d, offset %q: %s", w.Code, w.Header().Get("Upload-Offset"), w.Body)
+	}
+
+	r = newTusRequest(t, &second, video, http.MethodHead, "/api/tus/"+uploadID, nil)
+	r.SetPathValue("uploadID", uploadID)
+	w = httptest.NewRecorder()
+	second.handlerTusHead(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "600" {
+		t.Fatalf("HEAD on the other instance = %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	w = patchTusUpload(t, &second, video, uploadID, 600, body[600:])
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("last PATCH = %d: %s", w.Code, w.Body)
+	}
+
+	jobs, err := second.db.GetUnfinishedJobs(jobKindProcessVideo)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("jobs = %v, %v, want one", jobs, err)
+	}
+	entries, err := os.ReadDir(second.uploadDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("upload directory holds %v, %v, want the assembled upload", entries, err)
+	}
+	assembled, err := os.ReadFile(filepath.Join(second.uploadDir, entries[0].Name()))
+	if err != nil || !bytes.Equal(assembled, body) {
+		t.Errorf("assembled %d bytes, %v, want the %d uploaded", len(assembled), err, len(body))
+	}
+
+	// The chunks and the upload are gone once it's queued
+	chunks, err := first.videoStore.List(context.Background(), directUploadPrefix+"/")
+	if err != nil || len(chunks) != 0 {
+		t.Errorf("stored chunks = %v, %v, want none", chunks, err)
+	}
+	uploads, err := first.db.GetTusUploads()
+	if err != nil || len(uploads) != 0 {
+		t.Errorf("uploads = %v, %v, want none", uploads, err)
+	}
+}
+
+func TestTusPatchLocked(t *testing.T) {
+	cfg := newTestConfig(t, newFakeMediaProcessor(testProbe))
+	cfg.tusDir = t.TempDir()
+	video := newTestVideo(t, cfg)
+	now := time.Now().UTC()
+	upload, err := cfg.db.CreateTusUpload(database.CreateTusUploadParams{
+		VideoID:   video.ID,
+		UserID:    video.UserID,
+		Length:    100,
+		ExpiresAt: now.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A PATCH on another instance holds the upload
+	_, err = cfg.db.LockTusUpload(upload.ID, "elsewhere", now, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := patchTusUpload(t, cfg, video, upload.ID.String(), 0, mp4Head)
+	if w.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	saved, err := cfg.db.GetTusUpload(upload.ID)
+	if err != nil || saved.Offset != 0 {
+		t.Errorf("offset = %d, %v, want 0", saved.Offset, err)
+	}
+}
@@ -1,14 +1,11 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
-	"mime"
+	"log"
 	"net/http"
-	"os"
-	"path/filepath"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/google/uuid"
@@ -36,6 +33,18 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 
 	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
 
+	// Get the video's meta-data from the database
+	dbVideo, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	// Check if the video belongs to the user before reading the image
+	if dbVideo.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You don't own this video", nil)
+		return
+	}
+
 	// Set a max memory and parse the form
 	maxMemory := int64(10 << 20) // 10 MB
 	err = r.ParseMultipartForm(maxMemory)
@@ -45,75 +54,72 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Get the file from the form and get the content type
-	file, header, err := r.FormFile("thumbnail")
+	file, _, err := r.FormFile("thumbnail")
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Couldn't parse form", err)
 		return
 	}
 	defer file.Close()
 
-	contentType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	// Check the file really is an image, the client's Content-Type isn't trusted
+	_, err = validateImage(file)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse content type", err)
+		status, msg := mediaErrorStatus(err)
+		respondWithError(w, status, msg, err)
 		return
 	}
-	// Check if the content type is an image
-	if contentType != "image/jpeg" && contentType != "image/png" {
-		respondWithError(w, http.StatusBadRequest, "Invalid content type", nil)
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read thumbnail", err)
 		return
 	}
 
-	// Get the video's meta-data from the database
-	dbVideo, err := cfg.db.GetVideo(videoID)
+	// Resize and re-encode the image into the thumbnail store
+	ws, err := cfg.newWorkspace(int64(len(data)) * workspaceSizeFactor)
+	if errors.Is(err, errScratchFull) {
+		respondWithError(w, http.StatusInsufficientStorage, "Not enough space for the upload", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create workspace", err)
 		return
 	}
-	// Check if the video belongs to the user
-	if dbVideo.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "You don't own this video", nil)
+	defer ws.Close()
+	thumbnail, err := cfg.storeThumbnail(r.Context(), ws, data)
+	if errors.Is(err, errInvalidMedia) {
+		respondWithError(w, http.StatusUnprocessableEntity, "Invalid media file", err)
 		return
 	}
-	// Create the file path for the thumbnail
-	extention := contentType[6:] // remove the "image/" part
-	// Generate a unique file name
-	thumbnailID := make([]byte, 32)
-	_, err = rand.Read(thumbnailID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random bytes", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail", err)
 		return
 	}
-	// Convert the thumbnailID to a string
-	thumbnailIDString := base64.RawURLEncoding.EncodeToString(thumbnailID)
-
-	thumbnailFilePath := filepath.Join(cfg.assetsRoot, thumbnailIDString+"."+extention)
-	fmt.Println("thumbnail file path: ", thumbnailFilePath)
 
-	// Create the thumbnail file
-	thumbnailFile, err := os.Create(thumbnailFilePath)
+	// Save the new thumbnail keys to the database
+	replaced := thumbnailAssets(dbVideo)
+	dbVideo.ThumbnailURL = &thumbnail.Key
+	dbVideo.Thumbnails = thumbnail.Variants
+	err = cfg.db.UpdateVideo(dbVideo)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create thumbnail file", err)
+		cfg.deleteThumbnail(r.Context(), thumbnail.Variants)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
 		return
 	}
 
-	// Write the file data to the thumbnail file
-	_, err = io.Copy(thumbnailFile, file)
+	// The previous thumbnail isn't referenced anymore
+	err = cfg.scheduleAssetDeletion(videoID, replaced)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't copy file", err)
-		return
+		log.Printf("Couldn't schedule deleting the old thumbnail of video %s: %v", videoID, err)
 	}
-	defer thumbnailFile.Close()
 
-	// Save the new thumbnail url to the database
-	thumbnailURL := fmt.Sprintf("http://localhost:%s/assets/%s.%s", cfg.port, thumbnailIDString, extention)
-	dbVideo.ThumbnailURL = &thumbnailURL
-	err = cfg.db.UpdateVideo(dbVideo)
+	// Respond with the videos meta-data
+	dbVideo, err = cfg.videoWithURLs(r.Context(), dbVideo)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't build video URLs", err)
 		return
 	}
 
-	// Respond with the videos meta-data
 	respondWithJSON(w, http.StatusOK, dbVideo)
 
 }
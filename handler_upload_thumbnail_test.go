@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// Someone else's video is refused before their image is read, it would be
+// rejected as too large otherwise
+func TestHandlerUploadThumbnailNotOwner(t *testing.T) {
+	cfg := newTestConfig(t, nil)
+	video := newTestVideo(t, cfg)
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	part, err := writer.CreateFormFile("thumbnail", "huge.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(pngWithSize(t, 10000, 5000))
+	writer.Close()
+
+	token, err := auth.MakeJWT(uuid.New(), cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/thumbnail_upload/"+video.ID.String(), &form)
+	r.SetPathValue("videoID", video.ID.String())
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusUnauthorized, w.Body)
+	}
+}
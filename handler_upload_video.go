@@ -1,25 +1,26 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"mime"
+	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/google/uuid"
 )
 
+// maxVideoUploadSize is the largest video a user can upload
+const maxVideoUploadSize = 1 << 30 // 1 GB
+
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
 
 	// Set an upload limit
-	maxUpload := int64(1 << 30) // 1 GB
-	r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+	r.Body = http.MaxBytesReader(w, r.Body, maxVideoUploadSize)
 
 	// Get the video ID from the URL
 	videoIDString := r.PathValue("videoID")
@@ -53,125 +54,142 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Set a max memory and parse the form
-	err = r.ParseMultipartForm(maxUpload)
+	// Only one upload of a video is queued at a time, refuse this one before
+	// reading it if another is queued or processing
+	started, err := cfg.db.StartVideoProcessing(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Max Memory exceded", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
 		return
 	}
-	file, header, err := r.FormFile("video")
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse form", err)
+	if !started {
+		respondWithError(w, http.StatusConflict, "Video is already being processed", nil)
 		return
 	}
-	defer file.Close()
+	// Put the status back unless the upload gets queued
+	queued := false
+	defer func() {
+		if queued {
+			return
+		}
+		err := cfg.db.UpdateVideoStatus(videoID, dbVideo.Status)
+		if err != nil {
+			log.Printf("Couldn't reset status of video %s: %v", videoID, err)
+		}
+	}()
 
-	// Check if the content type is video/mp4
-	contentType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse content type", err)
-		return
-	}
-	if contentType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Invalid content type", nil)
+	// Refuse the upload before reading it if the scratch disk can't hold it
+	err = cfg.checkScratchSpace(r.ContentLength)
+	if errors.Is(err, errScratchFull) {
+		respondWithError(w, http.StatusInsufficientStorage, "Not enough space for the upload", err)
 		return
 	}
-
-	// Save the video to a temporary file
-	tmpFile, err := os.CreateTemp("", "tubely-upload-*.mp4")
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create temporary file", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check free space", err)
 		return
 	}
 
-	_, err = io.Copy(tmpFile, file)
+	// Report the bytes received while the form is read
+	r.Body = newProgressReader(r.Body, r.ContentLength, func(read, total int64) {
+		cfg.progress.publish(videoID, byteProgress(progressStageUpload, read, total))
+	})
+
+	// Stream the file part instead of parsing the whole form, which would
+	// buffer it in memory or a temp file outside the upload directory
+	reader, err := r.MultipartReader()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save video", err)
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse form", err)
 		return
 	}
-	// Reset the file pointer to the beginning
-	_, err = tmpFile.Seek(0, io.SeekStart)
+	part, err := nextFormFile(reader, "video")
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't seek to beginning of file", err)
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse form", err)
 		return
 	}
-	defer tmpFile.Close()
+	defer part.Close()
 
-	// Generate a unique file name
-	videoFileID := make([]byte, 32)
-	_, err = rand.Read(videoFileID)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random bytes", err)
+	// Check the leading bytes are an accepted format, the client's Content-Type isn't trusted
+	file := bufio.NewReaderSize(part, sniffLen)
+	head, err := file.Peek(sniffLen)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read video", err)
 		return
 	}
-
-	// Check if the file exists
-	if _, err := os.Stat(tmpFile.Name()); err != nil {
-		fmt.Println("Temp file stat error:", err)
+	extension, ok := videoFormats[sniffMediaType(head)]
+	if !ok {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Unsupported media type", nil)
+		return
 	}
 
-	// Get the aspect ratio of the video
-	aspectRatio, err := getVideoAspectRatio(tmpFile.Name())
+	// Save the video to the upload directory, the processing job picks it up from there
+	uploadFile, err := os.CreateTemp(cfg.uploadDir, uploadPattern+"."+extension)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get video aspect ratio", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload file", err)
 		return
 	}
-	// Set the subdirectory for the video based on the aspect ratio
-	var subdirectory string
-	switch aspectRatio {
-	case "16:9":
-		subdirectory = "landscape"
-	case "9:16":
-		subdirectory = "portrait"
-	default:
-		subdirectory = "other"
-	}
+	// Remove the file on every way out unless the job took it over
+	defer func() {
+		uploadFile.Close()
+		if !queued {
+			os.Remove(uploadFile.Name())
+		}
+	}()
 
-	// Process the video for fast start
-	processedFileIDString, err := processVideoForFastStart(tmpFile.Name())
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't process video for fast start", err)
+	// The size may not have been known up front, so keep checking the space
+	_, err = io.Copy(cfg.newScratchWriter(uploadFile), file)
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errScratchFull):
+		respondWithError(w, http.StatusInsufficientStorage, "Not enough space for the upload", err)
+		return
+	case errors.As(err, &maxBytesErr):
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", err)
+		return
+	case err != nil:
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save video", err)
 		return
 	}
-	// Close the temporary file
-	defer tmpFile.Close()
-	defer os.Remove(tmpFile.Name())
 
-	// open the processed file
-	processedFile, err := os.Open(processedFileIDString)
+	// Make sure ffprobe can read a video stream before queueing it
+	_, err = cfg.validateVideoFile(r.Context(), uploadFile.Name())
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't open processed file", err)
+		status, msg := mediaErrorStatus(err)
+		respondWithError(w, status, msg, err)
 		return
 	}
-	defer processedFile.Close()
 
-	// Convert the processedFileID to a string and adds the file extension
-	videoFileIDString := subdirectory + "/" + base64.RawURLEncoding.EncodeToString([]byte(videoFileID)) + ".mp4"
-
-	// Put the file in S3
-	_, err = cfg.s3Client.PutObject(r.Context(), &s3.PutObjectInput{
-		Bucket:      aws.String(cfg.s3Bucket),
-		Key:         aws.String(videoFileIDString),
-		Body:        processedFile,
-		ContentType: aws.String(contentType),
+	// Queue the video for processing and respond right away
+	dbVideo, err = cfg.enqueueVideoProcessing(r.Context(), dbVideo, processVideoPayload{
+		SourcePath: uploadFile.Name(),
 	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't upload video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
 		return
 	}
+	queued = true
 
-	// Update the video metadata in the database
-	videoURL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s",
-		cfg.s3Bucket,
-		cfg.s3Region,
-		videoFileIDString)
-	dbVideo.VideoURL = &videoURL
-	err = cfg.db.UpdateVideo(dbVideo)
+	dbVideo, err = cfg.videoWithURLs(r.Context(), dbVideo)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't build video URLs", err)
 		return
 	}
-	// Respond with the video URL
-	respondWithJSON(w, http.StatusOK, dbVideo)
 
+	respondWithJSON(w, http.StatusAccepted, dbVideo)
+
+}
+
+// nextFormFile skips ahead to the file part of a multipart form named name
+func nextFormFile(reader *multipart.Reader, name string) (*multipart.Part, error) {
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("form has no %s file", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == name && part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
 }
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// Browsers upload straight to S3 below this prefix, the complete endpoint
+// moves the processed video to its final key
+const directUploadPrefix = "uploads"
+
+/*
+handlerVideoUploadPresign issues a presigned PUT request or POST policy that
+lets the browser upload a video straight to the bucket instead of through
+this server. The request body is {"method": "PUT"|"POST", "size": bytes,
+"content_type": "video/mp4"}, the content type defaults to MP4.
+*/
+func (cfg *apiConfig) handlerVideoUploadPresign(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Method      string `json:"method"`
+		Size        int64  `json:"size"`
+		ContentType string `json:"content_type"`
+	}
+
+	if cfg.uploadPresigner == nil {
+		respondWithError(w, http.StatusNotImplemented, "Direct uploads require s3 storage", nil)
+		return
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	dbVideo, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if dbVideo.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You don't own this video", nil)
+		return
+	}
+
+	if params.ContentType == "" {
+		params.ContentType = "video/mp4"
+	}
+	extension, ok := videoFormats[params.ContentType]
+	if !ok {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Unsupported media type", nil)
+		return
+	}
+
+	// Stage the upload below the video's own prefix
+	stagingKey, err := randomAssetKey(directUploadPrefix+"/"+videoID.String(), extension)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random bytes", err)
+		return
+	}
+
+	var upload storage.PresignedUpload
+	switch strings.ToUpper(params.Method) {
+	case http.MethodPut:
+		if params.Size <= 0 || params.Size > maxVideoUploadSize {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Size must be between 1 and %d bytes", maxVideoUploadSize), nil)
+			return
+		}
+		upload, err = cfg.uploadPresigner.PresignPut(r.Context(), stagingKey, params.ContentType, params.Size)
+	case http.MethodPost, "":
+		upload, err = cfg.uploadPresigner.PresignPost(r.Context(), stagingKey, params.ContentType, maxVideoUploadSize)
+	default:
+		respondWithError(w, http.StatusBadRequest, "Method must be PUT or POST", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, upload)
+}
+
+/*
+handlerVideoUploadComplete validates a direct upload like a proxied one and
+queues it for processing. The job removes the staged object when done, an
+upload that fails validation is removed right away.
+The request body is {"key": key} with the key returned by the presign endpoint.
+Completing an upload again while it's queued or processing returns 409.
+*/
+func (cfg *apiConfig) handlerVideoUploadComplete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key string `json:"key"`
+	}
+
+	if cfg.uploadPresigner == nil {
+		respondWithError(w, http.StatusNotImplemented, "Direct uploads require s3 storage", nil)
+		return
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	dbVideo, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if dbVideo.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You don't own this video", nil)
+		return
+	}
+
+	// Only accept keys that were issued for this video
+	if !strings.HasPrefix(params.Key, directUploadPrefix+"/"+videoID.String()+"/") {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload key", nil)
+		return
+	}
+
+	// Only one call gets to queue the upload, a repeated one finds the
+	// video processing already
+	started, err := cfg.db.StartVideoProcessing(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	if !started {
+		respondWithError(w, http.StatusConflict, "Video is already being processed", nil)
+		return
+	}
+	// Put the status back unless the upload gets queued
+	queued := false
+	defer func() {
+		if queued {
+			return
+		}
+		err := cfg.db.UpdateVideoStatus(videoID, dbVideo.Status)
+		if err != nil {
+			log.Printf("Couldn't reset status of video %s: %v", videoID, err)
+		}
+	}()
+
+	status, msg, err := cfg.validateStagedVideo(r.Context(), params.Key)
+	if status != http.StatusOK {
+		// An upload that isn't there can still be retried, a bad one can't
+		if status != http.StatusConflict && status != http.StatusInternalServerError {
+			deleteErr := cfg.videoStore.Delete(r.Context(), params.Key)
+			if deleteErr != nil {
+				log.Printf("Couldn't delete rejected upload %s: %v", params.Key, deleteErr)
+			}
+		}
+		respondWithError(w, status, msg, err)
+		return
+	}
+
+	// Queue the staged video for processing, the job removes it when done
+	dbVideo, err = cfg.enqueueVideoProcessing(r.Context(), dbVideo, processVideoPayload{
+		StagingKey: params.Key,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+		return
+	}
+	queued = true
+
+	dbVideo, err = cfg.videoWithURLs(r.Context(), dbVideo)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't build video URLs", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, dbVideo)
+}
+
+/*
+validateStagedVideo checks a direct upload like a proxied one: it has to be
+in the bucket, no larger than a proxied upload may be, of the content type
+it was presigned for, and probe as a video. ffprobe reads it through a
+presigned GET URL, so only the parts it needs are downloaded.
+It returns the HTTP status and message for the problem found.
+*/
+func (cfg *apiConfig) validateStagedVideo(ctx context.Context, key string) (int, string, error) {
+	info, err := cfg.videoStore.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return http.StatusConflict, "Video hasn't been uploaded", err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, "Couldn't check upload", err
+	}
+	if info.Size > maxVideoUploadSize {
+		return http.StatusRequestEntityTooLarge, "Video is too large", nil
+	}
+	if _, ok := videoFormats[info.ContentType]; !ok {
+		return http.StatusBadRequest, "Invalid content type", nil
+	}
+
+	// The client chose the Content-Type, check the bytes really match it
+	sniffed, err := cfg.sniffStoredObject(ctx, key)
+	if err != nil {
+		return http.StatusInternalServerError, "Couldn't check upload", err
+	}
+	if sniffed != info.ContentType {
+		return http.StatusUnsupportedMediaType, "Unsupported media type", nil
+	}
+
+	url, err := cfg.uploadPresigner.PresignGet(ctx, key)
+	if err != nil {
+		return http.StatusInternalServerError, "Couldn't check upload", err
+	}
+	err = cfg.probeVideo(ctx, url)
+	if err != nil {
+		status, msg := mediaErrorStatus(err)
+		return status, msg, err
+	}
+	return http.StatusOK, "", nil
+}
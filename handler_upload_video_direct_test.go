@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// newTestUploadPresigner presigns against a made up endpoint, signing needs
+// credentials but no network
+func newTestUploadPresigner() *storage.UploadPresigner {
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String("https://s3.example.com"),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+		}),
+	})
+	return storage.NewUploadPresigner(client, "tubely-test", 15*time.Minute)
+}
+
+// stageDirectUpload puts body in the video store like a browser would and
+// returns the staging key
+func stageDirectUpload(t *testing.T, cfg *apiConfig, video database.Video, body []byte) string {
+	t.Helper()
+	key := directUploadPrefix + "/" + video.ID.String() + "/staged.mp4"
+	err := cfg.videoStore.Put(context.Background(), key, bytes.NewReader(body), "video/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func completeDirectUpload(t *testing.T, cfg *apiConfig, video database.Video, key string) *httptest.ResponseRecorder {
+	t.Helper()
+	token, err := auth.MakeJWT(video.UserID, cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+video.ID.String()+"/complete", strings.NewReader(`{"key":"`+key+`"}`))
+	r.SetPathValue("videoID", video.ID.String())
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	cfg.handlerVideoUploadComplete(w, r)
+	return w
+}
+
+func TestHandlerVideoUploadComplete(t *testing.T) {
+	media := newFakeMediaProcessor(testProbe)
+	cfg := newTestConfig(t, media)
+	cfg.uploadPresigner = newTestUploadPresigner()
+	video := newTestVideo(t, cfg)
+	key := stageDirectUpload(t, cfg, video, mp4Head)
+
+	w := completeDirectUpload(t, cfg, video, key)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+
+	// ffprobe read the object through a presigned URL
+	calls := media.Calls()
+	if len(calls) != 1 || !calls[0].Probe {
+		t.Fatalf("calls = %v, want one probe", calls)
+	}
+	probed := calls[0].Args[0]
+	if !strings.HasPrefix(probed, "https://s3.example.com/tubely-test/"+key+"?") || !strings.Contains(probed, "X-Amz-Signature=") {
+		t.Errorf("probed %q, want a presigned URL of the object", probed)
+	}
+
+	// Completing again doesn't queue the upload twice
+	w = completeDirectUpload(t, cfg, video, key)
+	if w.Code != http.StatusConflict {
+		t.Errorf("repeated status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	jobs, err := cfg.db.GetUnfinishedJobs(jobKindProcessVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Errorf("%d process_video jobs queued, want 1", len(jobs))
+	}
+	if _, err := cfg.videoStore.Stat(context.Background(), key); err != nil {
+		t.Errorf("staged upload is gone after a repeated call: %v", err)
+	}
+}
+
+func TestHandlerVideoUploadCompleteRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    []byte
+		probe   FFProbeOutput
+		status  int
+		deleted bool
+	}{
+		{"ffprobe finds no video", mp4Head, FFProbeOutput{}, http.StatusUnprocessableEntity, true},
+		{"not the presigned type", []byte("GIF89a not a video"), testProbe, http.StatusUnsupportedMediaType, true},
+		{"not uploaded", nil, testProbe, http.StatusConflict, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, newFakeMediaProcessor(tt.probe))
+			cfg.uploadPresigner = newTestUploadPresigner()
+			video := newTestVideo(t, cfg)
+			key := directUploadPrefix + "/" + video.ID.String() + "/staged.mp4"
+			if tt.body != nil {
+				stageDirectUpload(t, cfg, video, tt.body)
+			}
+
+			w := completeDirectUpload(t, cfg, video, key)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			_, err := cfg.videoStore.Stat(context.Background(), key)
+			if tt.deleted && !errors.Is(err, storage.ErrNotFound) {
+				t.Errorf("rejected upload is still staged: %v", err)
+			}
+
+			// The status is put back so the upload can be tried again
+			saved, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.Status != video.Status {
+				t.Errorf("status = %q, want %q", saved.Status, video.Status)
+			}
+			jobs, err := cfg.db.GetUnfinishedJobs(jobKindProcessVideo)
+			if err != nil || len(jobs) != 0 {
+				t.Errorf("jobs = %v, %v, want none", jobs, err)
+			}
+		})
+	}
+}
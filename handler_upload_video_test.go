@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// mp4Head is the start of an MP4 file, enough to be sniffed as one
+var mp4Head = []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00isomiso2avc1mp41")
+
+// newVideoUploadRequest builds a multipart upload of body as the video field,
+// after a title field like the web app sends
+func newVideoUploadRequest(t *testing.T, cfg *apiConfig, video database.Video, body []byte) *http.Request {
+	t.Helper()
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	writer.WriteField("title", video.Title)
+	part, err := writer.CreateFormFile("video", "boots.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(body)
+	writer.Close()
+
+	token, err := auth.MakeJWT(video.UserID, cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+video.ID.String(), &form)
+	r.SetPathValue("videoID", video.ID.String())
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestHandlerUploadVideo(t *testing.T) {
+	cfg := newTestConfig(t, newFakeMediaProcessor(testProbe))
+	video := newTestVideo(t, cfg)
+	body := append(append([]byte(nil), mp4Head...), bytes.Repeat([]byte{0}, 1<<20)...)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, cfg, video, body))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+
+	job, err := cfg.db.ClaimJob(time.Now().UTC())
+	if err != nil || job == nil {
+		t.Fatalf("no job queued: %v", err)
+	}
+	var payload processVideoPayload
+	err = json.Unmarshal([]byte(job.Payload), &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(payload.SourcePath) != cfg.uploadDir || filepath.Ext(payload.SourcePath) != ".mp4" {
+		t.Errorf("source path = %q, want an .mp4 in %s", payload.SourcePath, cfg.uploadDir)
+	}
+	saved, err := os.ReadFile(payload.SourcePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved, body) {
+		t.Errorf("saved %d bytes, want the %d uploaded", len(saved), len(body))
+	}
+}
+
+func TestHandlerUploadVideoRejects(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           []byte
+		scratchMinFree int64
+		status         int
+	}{
+		{"unsupported type", []byte("GIF89a not a video"), 0, http.StatusUnsupportedMediaType},
+		{"scratch disk full", mp4Head, 1 << 62, http.StatusInsufficientStorage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, newFakeMediaProcessor(testProbe))
+			cfg.scratchMinFree = tt.scratchMinFree
+			video := newTestVideo(t, cfg)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, cfg, video, tt.body))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			entries, err := os.ReadDir(cfg.uploadDir)
+			if err != nil || len(entries) != 0 {
+				t.Errorf("upload directory holds %v, %v, want nothing", entries, err)
+			}
+			saved, err := cfg.db.GetVideo(video.ID)
+			if err != nil || saved.Status != video.Status {
+				t.Errorf("status = %q, %v, want %q put back", saved.Status, err, video.Status)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoConflict(t *testing.T) {
+	cfg := newTestConfig(t, newFakeMediaProcessor(testProbe))
+	video := newTestVideo(t, cfg)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, cfg, video, mp4Head))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+
+	// A second upload while the first is queued is refused
+	w = httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, cfg, video, mp4Head))
+	if w.Code != http.StatusConflict {
+		t.Errorf("second status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	jobs, err := cfg.db.GetUnfinishedJobs(jobKindProcessVideo)
+	if err != nil || len(jobs) != 1 {
+		t.Errorf("jobs = %v, %v, want one", jobs, err)
+	}
+	saved, err := cfg.db.GetVideo(video.ID)
+	if err != nil || saved.Status != database.VideoStatusUploaded {
+		t.Errorf("status = %q, %v, want %q", saved.Status, err, database.VideoStatusUploaded)
+	}
+}
+
+func TestScratchWriter(t *testing.T) {
+	cfg := newTestConfig(t, nil)
+	var buf bytes.Buffer
+	writer := cfg.newScratchWriter(&buf)
+	_, err := writer.Write([]byte("fits"))
+	if err != nil || buf.String() != "fits" {
+		t.Fatalf("Write = %v, wrote %q", err, buf.String())
+	}
+
+	// The space is checked again once enough has been written since the last check
+	cfg.scratchMinFree = 1 << 62
+	_, err = writer.Write(make([]byte, scratchCheckInterval))
+	if !errors.Is(err, errScratchFull) {
+		t.Errorf("Write error = %v, want errScratchFull", err)
+	}
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
@@ -72,12 +76,32 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	// Unfinished resumable uploads reference the row, drop them with their chunks
+	uploads, err := cfg.db.GetTusUploadsForVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get uploads", err)
+		return
+	}
+	for _, upload := range uploads {
+		err = cfg.removeTusUpload(r.Context(), upload)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't remove upload", err)
+			return
+		}
+	}
+
 	err = cfg.db.DeleteVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
 
+	// Remove the video's files in the background, the row is already gone
+	err = cfg.scheduleAssetDeletion(videoID, videoAssets(video).merge(thumbnailAssets(video)))
+	if err != nil {
+		log.Printf("Couldn't schedule deleting the files of video %s: %v", videoID, err)
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -95,6 +119,26 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	media, err := cfg.db.GetVideoMedia(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video media", err)
+		return
+	}
+	if media.VideoID != uuid.Nil {
+		video.Media = &media
+	}
+
+	err = cfg.setVideoCookies(w, video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video cookies", err)
+		return
+	}
+	video, err = cfg.videoWithURLs(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't build video URLs", err)
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, video)
 }
 
@@ -110,11 +154,56 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	filter, err := parseVideoFilter(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid filter", err)
+		return
+	}
+
+	videos, err := cfg.db.GetVideos(userID, filter)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
 
+	videos, err = cfg.videosWithURLs(r.Context(), videos)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't build video URLs", err)
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, videos)
 }
+
+/*
+parseVideoFilter reads the media filters of a video listing from the query string,
+e.g. ?min_duration=60&max_height=720&video_codec=h264
+*/
+func parseVideoFilter(query url.Values) (database.VideoFilter, error) {
+	var filter database.VideoFilter
+	var err error
+	if v := query.Get("min_duration"); v != "" {
+		if filter.MinDuration, err = strconv.ParseFloat(v, 64); err != nil {
+			return database.VideoFilter{}, fmt.Errorf("min_duration: %w", err)
+		}
+	}
+	if v := query.Get("max_duration"); v != "" {
+		if filter.MaxDuration, err = strconv.ParseFloat(v, 64); err != nil {
+			return database.VideoFilter{}, fmt.Errorf("max_duration: %w", err)
+		}
+	}
+	if v := query.Get("min_height"); v != "" {
+		if filter.MinHeight, err = strconv.Atoi(v); err != nil {
+			return database.VideoFilter{}, fmt.Errorf("min_height: %w", err)
+		}
+	}
+	if v := query.Get("max_height"); v != "" {
+		if filter.MaxHeight, err = strconv.Atoi(v); err != nil {
+			return database.VideoFilter{}, fmt.Errorf("max_height: %w", err)
+		}
+	}
+	filter.VideoCodec = query.Get("video_codec")
+	filter.AudioCodec = query.Get("audio_codec")
+	filter.Container = query.Get("container")
+	return filter, nil
+}
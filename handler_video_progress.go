@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+/*
+handlerVideoProgress streams upload and processing progress for a video as
+Server-Sent Events until the video is done or failed. EventSource can't set
+headers, so the JWT may also be passed in the token query parameter.
+A video that is already ready or failed gets its final event straight away,
+unless the client passes pending=1 because it subscribed ahead of an upload
+replacing the current file. A reconnecting EventSource always gets it.
+*/
+func (cfg *apiConfig) handlerVideoProgress(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	// Subscribe before reading the status, so a video finishing in between
+	// is either seen as finished or sends its final event
+	events, unsubscribe := cfg.progress.subscribe(videoID)
+	defer unsubscribe()
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You don't own this video", nil)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming unsupported", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	eventID := 0
+	send := func(event progressEvent) bool {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return false
+		}
+		eventID++
+		fmt.Fprintf(w, "id: %d\nevent: progress\ndata: %s\n\n", eventID, data)
+		flusher.Flush()
+		return true
+	}
+
+	resuming := r.Header.Get("Last-Event-ID") != ""
+	if r.URL.Query().Get("pending") == "" || resuming {
+		switch video.Status {
+		case database.VideoStatusReady:
+			send(progressEvent{Stage: progressStageDone, Percent: 100})
+			return
+		case database.VideoStatusFailed:
+			send(progressEvent{Stage: progressStageFailed, Message: "Video processing failed"})
+			return
+		}
+	}
+
+	// Comments keep proxies from closing an idle stream
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok || !send(event) || event.final() {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"math"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// hlsRendition is one rung of the adaptive bitrate ladder
+type hlsRendition struct {
+	Name         string
+	Height       int
+	VideoBitrate int // kbit/s
+	AudioBitrate int // kbit/s
+}
+
+var hlsLadder = []hlsRendition{
+	{Name: "1080p", Height: 1080, VideoBitrate: 5000, AudioBitrate: 192},
+	{Name: "720p", Height: 720, VideoBitrate: 2800, AudioBitrate: 128},
+	{Name: "480p", Height: 480, VideoBitrate: 1400, AudioBitrate: 128},
+	{Name: "360p", Height: 360, VideoBitrate: 800, AudioBitrate: 96},
+}
+
+const (
+	hlsSegmentSeconds  = 6
+	hlsMasterPlaylist  = "master.m3u8"
+	hlsPlaylistMIME    = "application/vnd.apple.mpegurl"
+	hlsSegmentMIME     = "video/mp2t"
+	hlsKeyframeSeconds = 2
+	// AAC-LC, the only audio codec the ladder uses
+	hlsAudioCodec = "mp4a.40.2"
+)
+
+// h264Level is a row of the H.264 level limits (Table A-1), for Main profile
+type h264Level struct {
+	IDC            int // level_idc, e.g. 31 for level 3.1
+	MaxMacroblocks int // per frame
+	MaxMBPerSecond int
+	MaxBitrate     int // kbit/s
+}
+
+var h264Levels = []h264Level{
+	{IDC: 30, MaxMacroblocks: 1620, MaxMBPerSecond: 40500, MaxBitrate: 10000},
+	{IDC: 31, MaxMacroblocks: 3600, MaxMBPerSecond: 108000, MaxBitrate: 14000},
+	{IDC: 32, MaxMacroblocks: 5120, MaxMBPerSecond: 216000, MaxBitrate: 20000},
+	{IDC: 40, MaxMacroblocks: 8192, MaxMBPerSecond: 245760, MaxBitrate: 20000},
+	{IDC: 41, MaxMacroblocks: 8192, MaxMBPerSecond: 245760, MaxBitrate: 50000},
+	{IDC: 42, MaxMacroblocks: 8704, MaxMBPerSecond: 522240, MaxBitrate: 50000},
+	{IDC: 50, MaxMacroblocks: 22080, MaxMBPerSecond: 589824, MaxBitrate: 135000},
+	{IDC: 51, MaxMacroblocks: 36864, MaxMBPerSecond: 983040, MaxBitrate: 240000},
+	{IDC: 52, MaxMacroblocks: 36864, MaxMBPerSecond: 2073600, MaxBitrate: 240000},
+}
+
+/*
+h264LevelFor returns the lowest level_idc that allows a width x height
+stream at frameRate and maxBitrate kbit/s. A frame rate of zero counts as
+30 fps. Level 3.0 is the lowest level used, players don't care for less.
+*/
+func h264LevelFor(width, height int, frameRate float64, maxBitrate int) int {
+	if frameRate <= 0 {
+		frameRate = 30
+	}
+	macroblocks := ((width + 15) / 16) * ((height + 15) / 16)
+	perSecond := int(math.Ceil(float64(macroblocks) * frameRate))
+	for _, level := range h264Levels {
+		if macroblocks <= level.MaxMacroblocks && perSecond <= level.MaxMBPerSecond && maxBitrate <= level.MaxBitrate {
+			return level.IDC
+		}
+	}
+	return h264Levels[len(h264Levels)-1].IDC
+}
+
+// h264LevelArg formats a level_idc the way ffmpeg's -level option takes it
+func h264LevelArg(idc int) string {
+	return fmt.Sprintf("%d.%d", idc/10, idc%10)
+}
+
+// h264MainCodec is the RFC 6381 codec string of a Main profile stream, as
+// x264 writes it: profile_idc 0x4d with constraint_set1_flag set
+func h264MainCodec(idc int) string {
+	return fmt.Sprintf("avc1.4d40%02x", idc)
+}
+
+/*
+hlsLadderFor picks the renditions that don't upscale the source
+Heights refer to the short side, so portrait videos get the same ladder
+as landscape ones. A source smaller than every rung gets a single rendition
+at its own size.
+*/
+func hlsLadderFor(width, height int) []hlsRendition {
+	shortSide := min(width, height)
+	ladder := []hlsRendition{}
+	for _, rendition := range hlsLadder {
+		if rendition.Height <= shortSide {
+			ladder = append(ladder, rendition)
+		}
+	}
+	if len(ladder) == 0 {
+		smallest := hlsLadder[len(hlsLadder)-1]
+		smallest.Name = fmt.Sprintf("%dp", shortSide)
+		smallest.Height = shortSide
+		ladder = append(ladder, smallest)
+	}
+	return ladder
+}
+
+// maxBitrate is the peak video bitrate the encoder is held to, in kbit/s
+func (r hlsRendition) maxBitrate() int {
+	return r.VideoBitrate * 107 / 100
+}
+
+// level returns the H.264 level_idc of the rendition of a source video
+func (r hlsRendition) level(width, height int, frameRate float64) int {
+	w, h := r.scaledSize(width, height)
+	return h264LevelFor(w, h, frameRate, r.maxBitrate())
+}
+
+// scaledSize returns the output size of a rendition, keeping the source
+// aspect ratio and rounding to the even sizes H.264 needs
+func (r hlsRendition) scaledSize(width, height int) (int, int) {
+	even := func(n float64) int {
+		return int(n/2+0.5) * 2
+	}
+	if width >= height {
+		return even(float64(width) * float64(r.Height) / float64(height)), r.Height
+	}
+	return r.Height, even(float64(height) * float64(r.Height) / float64(width))
+}
+
+/*
+transcodeHLS uses ffmpeg to transcode a video into an HLS ladder in outputDir
+Every rendition gets its own media playlist and segments, and a master
+playlist referencing all of them is written last.
+onProgress, if not nil, is called with the fraction of the whole ladder done.
+It returns the name of the master playlist or an error if ffmpeg fails.
+*/
+func transcodeHLS(ctx context.Context, media MediaProcessor, filePath, outputDir string, probe FFProbeOutput, onProgress func(float64)) (string, error) {
+	stream, ok := probe.videoStream()
+	displayWidth, displayHeight := stream.displaySize()
+	if !ok || displayWidth == 0 || displayHeight == 0 {
+		return "", fmt.Errorf("no video stream to transcode in %s", filePath)
+	}
+	duration := probe.duration()
+	frameRate := parseFrameRate(stream.AvgFrameRate)
+	ladder := hlsLadderFor(displayWidth, displayHeight)
+
+	for i, rendition := range ladder {
+		width, height := rendition.scaledSize(displayWidth, displayHeight)
+		keyframes := fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsKeyframeSeconds)
+		err := media.Run(ctx, []string{
+			"-i", filePath,
+			"-map", "0:v:0",
+			"-map", "0:a:0?",
+			"-vf", fmt.Sprintf("scale=%d:%d", width, height),
+			"-c:v", "libx264",
+			"-preset", "veryfast",
+			"-profile:v", "main",
+			"-level:v", h264LevelArg(rendition.level(displayWidth, displayHeight, frameRate)),
+			"-b:v", fmt.Sprintf("%dk", rendition.VideoBitrate),
+			"-maxrate", fmt.Sprintf("%dk", rendition.maxBitrate()),
+			"-bufsize", fmt.Sprintf("%dk", rendition.VideoBitrate*3/2),
+			"-force_key_frames", keyframes,
+			"-c:a", "aac",
+			"-b:a", fmt.Sprintf("%dk", rendition.AudioBitrate),
+			"-ac", "2",
+			"-f", "hls",
+			"-hls_time", fmt.Sprint(hlsSegmentSeconds),
+			"-hls_playlist_type", "vod",
+			"-hls_segment_filename", filepath.Join(outputDir, rendition.Name+"_%04d.ts"),
+			filepath.Join(outputDir, rendition.Name+".m3u8"),
+		}, func(done time.Duration) {
+			if onProgress != nil && duration > 0 {
+				onProgress((float64(i) + min(1, float64(done)/float64(duration))) / float64(len(ladder)))
+			}
+		})
+		if err != nil {
+			return "", fmt.Errorf("couldn't transcode %s rendition: %w", rendition.Name, err)
+		}
+	}
+
+	master := hlsMasterPlaylistFor(ladder, displayWidth, displayHeight, frameRate, probe.hasAudio())
+	err := os.WriteFile(filepath.Join(outputDir, hlsMasterPlaylist), []byte(master), 0644)
+	if err != nil {
+		return "", err
+	}
+	return hlsMasterPlaylist, nil
+}
+
+/*
+hlsMasterPlaylistFor lists the renditions of a ladder, highest first
+CODECS names the level each rendition is encoded at, and AAC only when the
+source has audio, so strict players can pick the renditions they can play.
+*/
+func hlsMasterPlaylistFor(ladder []hlsRendition, width, height int, frameRate float64, hasAudio bool) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, rendition := range ladder {
+		w, h := rendition.scaledSize(width, height)
+		bandwidth := rendition.maxBitrate() * 1000
+		codecs := h264MainCodec(rendition.level(width, height, frameRate))
+		if hasAudio {
+			bandwidth += rendition.AudioBitrate * 1000
+			codecs += "," + hlsAudioCodec
+		}
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"%s\"\n", bandwidth, w, h, codecs)
+		fmt.Fprintf(&b, "%s.m3u8\n", rendition.Name)
+	}
+	return b.String()
+}
+
+// putDirectory puts every file below dir in the video store under prefix
+func (cfg *apiConfig) putDirectory(ctx context.Context, dir, prefix string) error {
+	return filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		key := path.Join(prefix, filepath.ToSlash(rel))
+		return cfg.videoStore.Put(ctx, key, file, streamingContentType(key))
+	})
+}
+
+// streamingContentType returns the MIME type of HLS, DASH and preview files
+func streamingContentType(key string) string {
+	switch path.Ext(key) {
+	case ".m3u8":
+		return hlsPlaylistMIME
+	case ".ts":
+		return hlsSegmentMIME
+	case ".mpd":
+		return dashManifestMIME
+	case ".m4s":
+		return cmafSegmentMIME
+	case ".vtt":
+		return previewTrackMIME
+	}
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
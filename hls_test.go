@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestH264LevelFor(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		frameRate     float64
+		maxBitrate    int
+		want          int
+	}{
+		{"360p", 640, 360, 30, 856, 30},
+		{"480p", 854, 480, 30, 1498, 31},
+		{"480p at level 3.0 rates", 720, 480, 30, 1498, 30},
+		{"720p", 1280, 720, 30, 2996, 31},
+		{"720p60", 1280, 720, 60, 2996, 32},
+		{"1080p", 1920, 1080, 30, 5350, 40},
+		{"1080p portrait", 1080, 1920, 30, 5350, 40},
+		{"1080p60", 1920, 1080, 60, 5350, 42},
+		{"unknown frame rate", 1920, 1080, 0, 5350, 40},
+		{"tiny", 320, 180, 30, 856, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := h264LevelFor(tt.width, tt.height, tt.frameRate, tt.maxBitrate)
+			if got != tt.want {
+				t.Errorf("h264LevelFor = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHLSMasterPlaylistCodecs(t *testing.T) {
+	ladder := hlsLadderFor(1920, 1080)
+
+	master := hlsMasterPlaylistFor(ladder, 1920, 1080, 30, true)
+	for _, want := range []string{
+		`RESOLUTION=1920x1080,CODECS="avc1.4d4028,mp4a.40.2"`,
+		`RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2"`,
+		`RESOLUTION=854x480,CODECS="avc1.4d401f,mp4a.40.2"`,
+		`RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2"`,
+	} {
+		if !strings.Contains(master, want) {
+			t.Errorf("master playlist is missing %s:\n%s", want, master)
+		}
+	}
+
+	silent := hlsMasterPlaylistFor(ladder, 1920, 1080, 30, false)
+	if strings.Contains(silent, "mp4a") {
+		t.Errorf("master playlist of a video without audio lists AAC:\n%s", silent)
+	}
+	if !strings.Contains(silent, `CODECS="avc1.4d4028"`) {
+		t.Errorf("master playlist lacks the 1080p video codec:\n%s", silent)
+	}
+}
@@ -0,0 +1,569 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/*
+testDatabases runs test against a new SQLite database and, when DB_URL is a
+postgres:// URL, against that database too. DB_URL has to point at a
+throwaway database: the tests migrate it and delete every row in it.
+*/
+func testDatabases(t *testing.T, test func(t *testing.T, c Client)) {
+	t.Run(DialectSQLite, func(t *testing.T) {
+		c, err := NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		test(t, c)
+	})
+
+	t.Run(DialectPostgres, func(t *testing.T) {
+		dsn := os.Getenv("DB_URL")
+		if dialect, _, _ := parseDSN(dsn); dsn == "" || dialect != DialectPostgres {
+			t.Skip("DB_URL isn't set to a Postgres database")
+		}
+		c, err := NewClient(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		err = c.Reset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		test(t, c)
+	})
+}
+
+func createTestUser(t *testing.T, c Client, email string) User {
+	t.Helper()
+	user, err := c.CreateUser(CreateUserParams{Email: email, Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *user
+}
+
+func createTestVideo(t *testing.T, c Client, userID uuid.UUID) Video {
+	t.Helper()
+	video, err := c.CreateVideo(CreateVideoParams{Title: "Boots", Description: "A video", UserID: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
+
+func TestUsers(t *testing.T) {
+	testDatabases(t, func(t *testing.T, c Client) {
+		user := createTestUser(t, c, "boots@example.com")
+
+		got, err := c.GetUserByEmail("boots@example.com")
+		if err != nil || got.ID != user.ID || got.Password != "hash" {
+			t.Errorf("GetUserByEmail = %+v, %v", got, err)
+		}
+		_, err = c.CreateUser(CreateUserParams{Email: "boots@example.com", Password: "other"})
+		if err == nil {
+			t.Error("created a second user with the same email")
+		}
+
+		err = c.DeleteUser(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted, err := c.GetUser(user.ID)
+		if err != nil || deleted != nil {
+			t.Errorf("GetUser after delete = %+v, %v, want nil", deleted, err)
+		}
+	})
+}
+
+func TestVideos(t *testing.T) {
+	testDatabases(t, func(t *testing.T, c Client) {
+		user := createTestUser(t, c, "boots@example.com")
+		video := createTestVideo(t, c, user.ID)
+
+		got, err := c.GetVideo(video.ID)
+		if err != nil || got.ID != video.ID || got.UserID != user.ID || got.Title != "Boots" {
+			t.Fatalf("GetVideo = %+v, %v", got, err)
+		}
+
+		key := "landscape/abc.mp4"
+		manifest := "landscape/abc/hls/master.m3u8"
+		got.VideoURL = &key
+		got.ManifestURL = &manifest
+		got.Outputs = VideoOutputs{VideoOutputMP4, VideoOutputHLS}
+		got.Thumbnails = ThumbnailVariants{"jpeg": {"640w": "abc/640.jpeg"}}
+		got.Status = VideoStatusReady
+		err = c.UpdateVideo(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		updated, err := c.GetVideo(video.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.VideoURL == nil || *updated.VideoURL != key || updated.ManifestURL == nil || *updated.ManifestURL != manifest {
+			t.Errorf("keys = %v, %v", updated.VideoURL, updated.ManifestURL)
+		}
+		if len(updated.Outputs) != 2 || updated.Thumbnails["jpeg"]["640w"] != "abc/640.jpeg" || updated.Status != VideoStatusReady {
+			t.Errorf("updated video = %+v", updated)
+		}
+
+		videos, err := c.GetVideos(user.ID, VideoFilter{})
+		if err != nil || len(videos) != 1 {
+			t.Errorf("GetVideos = %v, %v, want one video", videos, err)
+		}
+
+		err = c.DeleteVideo(video.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		missing, err := c.GetVideo(video.ID)
+		if err != nil || missing.ID != uuid.Nil {
+			t.Errorf("GetVideo after delete = %+v, %v, want a zero video", missing, err)
+		}
+	})
+}
+
+func TestStartVideoProcessing(t *testing.T) {
+	testDatabases(t, func(t *testing.T, c Client) {
+		user := createTestUser(t, c, "boots@example.com")
+		video := createTestVideo(t, c, user.ID)
+
+		// Concurrent callers: exactly one starts processing
+		var wg sync.WaitGroup
+		results := make(chan bool, 8)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				started, err := c.StartVideoProcessing(video.ID)
+				if err != nil {
+					t.Error(err)
+				}
+				results <- started
+			}()
+		}
+		wg.Wait()
+		close(results)
+		started := 0
+		for result := range results {
+			if result {
+				started++
+			}
+		}
+		if started != 1 {
+			t.Errorf("%d callers started processing, want 1", started)
+		}
+
+		// Once the video is done it can be uploaded and processed again
+		err := c.UpdateVideoStatus(video.ID, VideoStatusReady)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := c.StartVideoProcessing(video.ID)
+		if err != nil || !again {
+			t.Errorf("StartVideoProcessing of a ready video = %v, %v, want true", again, err)
+		}
+	})
+}
+
+func TestRefreshTokens(t *testing.T) {
+	testDatabases(t, func(t *testing.T, c Client) {
+		user := createTestUser(t, c, "boots@example.com")
+		expires := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+		_, err := c.CreateRefreshToken(CreateRefreshTokenParams{Token: "token", UserID: user.ID, ExpiresAt: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		owner, err := c.GetUserByRefreshToken("token")
+		if err != nil || owner == nil || owner.ID != user.ID {
+			t.Errorf("GetUserByRefreshToken = %+v, %v", owner, err)
+		}
+		err = c.RevokeRefreshToken("token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := c.GetRefreshToken("token")
+		if err != nil || token.RevokedAt == nil || !token.ExpiresAt.Equal(expires) {
+			t.Errorf("GetRefreshToken = %+v, %v, want it revoked and expiring at %s", token, err, expires)
+		}
+	})
+}
+
+func TestJobs(t *testing.T) {
+	testDatabases(t, func(t *testing.T, c Client) {
+		now := time.Now().UTC()
+		first, err := c.CreateJob(CreateJobParams{Kind: "process_video", Payload: `{"n":1}`, MaxAttempts: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := c.CreateJob(CreateJobParams{Kind: "process_video", Payload: `{"n":2}`, MaxAttempts: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		claimed, err := c.ClaimJob(now.Add(time.Second))
+		if err != nil || claimed == nil || claimed.ID != first.ID {
+			t.Fatalf("ClaimJob = %+v, %v, want the oldest job", claimed, err)
+		}
+		if claimed.Status != JobStatusRunning || claimed.Attempts != 1 || claimed.Payload != `{"n":1}` {
+			t.Errorf("claimed job = %+v", claimed)
+		}
+
+		// A retried job waits until it's due again
+		err = c.RetryJob(first.ID, 1, "boom", now.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		claimed, err = c.ClaimJob(now.Add(time.Second))
+		if err != nil || claimed == nil || claimed.ID != second.ID {
+			t.Fatalf("ClaimJob = %+v, %v, want the second job", claimed, err)
+		}
+		none, err := c.ClaimJob(now.Add(time.Second))
+		if err != nil || none != nil {
+			t.Errorf("ClaimJob with nothing due = %+v, %v, want nil", none, err)
+		}
+		retried, err := c.ClaimJob(now.Add(2 * time.Hour))
+		if err != nil || retried == nil || retried.ID != first.ID || retried.Attempts != 2 {
+			t.Fatalf("ClaimJob after the retry delay = %+v, %v", retried, err)
+		}
+		if retried.LastError == nil || *retried.LastError != "boom" {
+			t.Errorf("last error = %v, want boom", retried.LastError)
+		}
+
+		err = c.FailJob(first.ID, 2, "boom again")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.CompleteJob(second.ID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unfinished, err := c.GetUnfinishedJobs("process_video")
+		if err != nil || len(unfinished) != 0 {
+			t.Errorf("GetUnfinishedJobs = %v, %v, want none", unfinished, err)
+		}
+		failed, err := c.GetJob(first.ID)
+		if err != nil || failed.Status != JobStatusFailed {
+			t.Errorf("failed job = %+v, %v", failed, err)
+		}
+	})
+}
+
+func TestRequeueStaleJobs(t *testing.T) {
+	testDatabases(t, func(t *testing.T, c Client) {
+		job, err := c.CreateJob(CreateJobParams{Kind: "delete_assets", Payload: "{}", MaxAttempts: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		claimedAt := time.Now().UTC().Add(time.Second)
+		claimed, err := c.ClaimJob(claimedAt)
+		if err != nil || claimed == nil || claimed.ID != job.ID {
+			t.Fatalf("ClaimJob = %+v, %v", claimed, err)
+		}
+
+		requeued, err := c.RequeueStaleJobs(claimedAt.Add(-time.Minute))
+		if err != nil || requeued != 0 {
+			t.Errorf("RequeueStaleJobs of a fresh claim = %d, %v, want 0", requeued, err)
+		}
+		requeued, err = c.RequeueStaleJobs(claimedAt.Add(time.Minute))
+		if err != nil || requeued != 1 {
+			t.Errorf("RequeueStaleJobs = %d, %v, want 1", requeued, err)
+		}
+		again, err := c.ClaimJob(claimedAt.Add(time.Minute))
+		if err != nil || again == nil || again.ID != job.ID || again.Attempts != 2 {
+			t.Fatalf("ClaimJob after requeueing = %+v, %v", again, err)
+		}
+
+		// The first worker finishing late can't touch the new claim
+		for name, finish := range map[string]func() error{
+			"CompleteJob": func() error { return c.CompleteJob(job.ID, claimed.Attempts) },
+			"RetryJob":    func() error { return c.RetryJob(job.ID, claimed.Attempts, "late", claimedAt) },
+			"FailJob":     func() error { return c.FailJob(job.ID, claimed.Attempts, "late") },
+		} {
+			err := finish()
+			if !errors.Is(err, ErrJobClaimLost) {
+				t.Errorf("%s with the old claim = %v, want ErrJobClaimLost", name, err)
+			}
+		}
+		current, err := c.GetJob(job.ID)
+		if err != nil || current.Status != JobStatusRunning || current.LastError != nil {
+			t.Errorf("job after late updates = %+v, %v, want it still running", current, err)
+		}
+		err = c.CompleteJob(job.ID, again.Attempts)
+		if err != nil {
+			t.Errorf("CompleteJob with the current claim = %v", err)
+		}
+	})
+}
+
+// Workers on several instances claim from the same queue, every job has to
+// be claimed exactly once
+func TestClaimJobConcurrently(t *testing.T) {
+	testDatabases(t, func(t *testing.T, c Client) {
+		const jobs, workers = 20, 5
+		for i := 0; i < jobs; i++ {
+			_, err := c.CreateJob(CreateJobParams{Kind: "delete_assets", Payload: "{}", MaxAttempts: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var mu sync.Mutex
+		claims := map[uuid.UUID]int{}
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					job, err := c.ClaimJob(time.Now().UTC().Add(time.Second))
+					if err != nil {
+						// SQLite reports a busy database rather than waiting
+						continue
+					}
+					if job == nil {
+						return
+					}
+					mu.Lock()
+					claims[job.ID]++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if len(claims) != jobs {
+			t.Errorf("%d jobs claimed, want %d", len(claims), jobs)
+		}
+		for id, n := range claims {
+			if n != 1 {
+				t.Errorf("job %s claimed %d times", id, n)
+			}
+		}
+	})
+}
+
+func TestTusUploadLock(t *testing.T) {
+	testDatabases(t, func(t *testing.T, c Client) {
+		user := createTestUser(t, c, "boots@example.com")
+		video := createTestVideo(t, c, user.ID)
+		now := time.Now().UTC()
+		upload, err := c.CreateTusUpload(CreateTusUploadParams{VideoID: video.ID, UserID: user.ID, Length: 1000, ExpiresAt: now.Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		locked, err := c.LockTusUpload(upload.ID, "first", now, now.Add(time.Minute))
+		if err != nil || !locked {
+			t.Fatalf("LockTusUpload = %v, %v, want the lock", locked, err)
+		}
+		locked, err = c.LockTusUpload(upload.ID, "second", now, now.Add(time.Minute))
+		if err != nil || locked {
+			t.Errorf("LockTusUpload of a held lock = %v, %v, want it refused", locked, err)
+		}
+		err = c.UpdateTusUploadOffset(upload.ID, "second", 100, now.Add(time.Hour))
+		if !errors.Is(err, ErrTusUploadLockLost) {
+			t.Errorf("UpdateTusUploadOffset without the lock = %v, want ErrTusUploadLockLost", err)
+		}
+
+		// A lock its holder stopped renewing can be taken over
+		later := now.Add(2 * time.Minute)
+		locked, err = c.LockTusUpload(upload.ID, "second", later, later.Add(time.Minute))
+		if err != nil || !locked {
+			t.Fatalf("LockTusUpload of an expired lock = %v, %v, want the lock", locked, err)
+		}
+		err = c.UpdateTusUploadOffset(upload.ID, "first", 100, now.Add(time.Hour))
+		if !errors.Is(err, ErrTusUploadLockLost) {
+			t.Errorf("UpdateTusUploadOffset with the expired lock = %v, want ErrTusUploadLockLost", err)
+		}
+
+		err = c.UnlockTusUpload(upload.ID, "second")
+		if err != nil {
+			t.Fatal(err)
+		}
+		locked, err = c.LockTusUpload(upload.ID, "third", later, later.Add(time.Minute))
+		if err != nil || !locked {
+			t.Errorf("LockTusUpload after unlocking = %v, %v, want the lock", locked, err)
+		}
+	})
+}
+
+func TestTusUploads(t *testing.T) {
+	testDatabases(t, func(t *testing.T, c Client) {
+		user := createTestUser(t, c, "boots@example.com")
+		video := createTestVideo(t, c, user.ID)
+		now := time.Now().UTC()
+		upload, err := c.CreateTusUpload(CreateTusUploadParams{
+			VideoID:   video.ID,
+			UserID:    user.ID,
+			Length:    1000,
+			Metadata:  "filename Ym9vdHMubXA0",
+			ExpiresAt: now.Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		locked, err := c.LockTusUpload(upload.ID, "first", now, now.Add(time.Minute))
+		if err != nil || !locked {
+			t.Fatalf("LockTusUpload = %v, %v, want the lock", locked, err)
+		}
+		err = c.UpdateTusUploadOffset(upload.ID, "first", 400, now.Add(2*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.GetTusUpload(upload.ID)
+		if err != nil || got.Offset != 400 || got.Length != 1000 || got.VideoID != video.ID {
+			t.Errorf("GetTusUpload = %+v, %v", got, err)
+		}
+
+		expired, err := c.GetExpiredTusUploads(now.Add(90 * time.Minute))
+		if err != nil || len(expired) != 0 {
+			t.Errorf("GetExpiredTusUploads before expiry = %v, %v", expired, err)
+		}
+		expired, err = c.GetExpiredTusUploads(now.Add(3 * time.Hour))
+		if err != nil || len(expired) != 1 {
+			t.Errorf("GetExpiredTusUploads after expiry = %v, %v", expired, err)
+		}
+		forVideo, err := c.GetTusUploadsForVideo(video.ID)
+		if err != nil || len(forVideo) != 1 {
+			t.Errorf("GetTusUploadsForVideo = %v, %v", forVideo, err)
+		}
+
+		err = c.DeleteTusUpload(upload.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gone, err := c.GetTusUpload(upload.ID)
+		if err != nil || gone.ID != uuid.Nil {
+			t.Errorf("GetTusUpload after delete = %+v, %v", gone, err)
+		}
+	})
+}
+
+func TestVideoMedia(t *testing.T) {
+	testDatabases(t, func(t *testing.T, c Client) {
+		user := createTestUser(t, c, "boots@example.com")
+		video := createTestVideo(t, c, user.ID)
+
+		media := VideoMedia{VideoID: video.ID, Duration: 10, Width: 1920, Height: 1080, VideoCodec: "h264", FrameRate: 29.97}
+		err := c.UpsertVideoMedia(media)
+		if err != nil {
+			t.Fatal(err)
+		}
+		media.Height = 720
+		err = c.UpsertVideoMedia(media)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.GetVideoMedia(video.ID)
+		if err != nil || got.Height != 720 || got.FrameRate != 29.97 || got.VideoCodec != "h264" {
+			t.Errorf("GetVideoMedia = %+v, %v", got, err)
+		}
+
+		tall, err := c.GetVideos(user.ID, VideoFilter{MinHeight: 1080})
+		if err != nil || len(tall) != 0 {
+			t.Errorf("GetVideos with MinHeight 1080 = %v, %v, want none", tall, err)
+		}
+	})
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+	testDatabases(t, func(t *testing.T, c Client) {
+		latest, err := c.SchemaVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rolledBack, err := c.MigrateDown()
+		if err != nil || rolledBack == nil {
+			t.Fatalf("MigrateDown = %v, %v", rolledBack, err)
+		}
+		version, err := c.SchemaVersion()
+		if err != nil || version != latest-1 {
+			t.Errorf("version after MigrateDown = %d, %v, want %d", version, err, latest-1)
+		}
+
+		err = c.MigrateUp()
+		if err != nil {
+			t.Fatal(err)
+		}
+		version, err = c.SchemaVersion()
+		if err != nil || version != latest {
+			t.Errorf("version after MigrateUp = %d, %v, want %d", version, err, latest)
+		}
+	})
+}
+
+func TestDeleteUserCascades(t *testing.T) {
+	testDatabases(t, func(t *testing.T, c Client) {
+		user := createTestUser(t, c, "boots@example.com")
+		other := createTestUser(t, c, "lane@example.com")
+		video := createTestVideo(t, c, user.ID)
+		kept := createTestVideo(t, c, other.ID)
+		for _, v := range []Video{video, kept} {
+			err := c.UpsertVideoMedia(VideoMedia{VideoID: v.ID, Width: 1280, Height: 720})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		upload, err := c.CreateTusUpload(CreateTusUploadParams{VideoID: video.ID, UserID: user.ID, Length: 1000, ExpiresAt: time.Now().UTC().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.CreateRefreshToken(CreateRefreshTokenParams{Token: "token", UserID: user.ID, ExpiresAt: time.Now().UTC().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.DeleteUser(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, check := range []struct {
+			query string
+			arg   any
+		}{
+			{"SELECT COUNT(*) FROM videos WHERE user_id = ?", user.ID},
+			{"SELECT COUNT(*) FROM video_media WHERE video_id = ?", video.ID},
+			{"SELECT COUNT(*) FROM tus_uploads WHERE id = ?", upload.ID},
+			{"SELECT COUNT(*) FROM refresh_tokens WHERE user_id = ?", user.ID},
+		} {
+			var count int
+			err := c.db.QueryRow(check.query, check.arg).Scan(&count)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 0 {
+				t.Errorf("%s: %d rows left after deleting the user", check.query, count)
+			}
+		}
+
+		// The other user's rows are untouched
+		media, err := c.GetVideoMedia(kept.ID)
+		if err != nil || media.Height != 720 {
+			t.Errorf("GetVideoMedia of another user's video = %+v, %v", media, err)
+		}
+	})
+}
+
+func TestCreateVideoForUnknownUser(t *testing.T) {
+	testDatabases(t, func(t *testing.T, c Client) {
+		_, err := c.CreateVideo(CreateVideoParams{Title: "Boots", UserID: uuid.New()})
+		if err == nil {
+			t.Error("created a video for a user that doesn't exist")
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// SQL flavours a Client can talk to
+const (
+	DialectSQLite   = "sqlite"
+	DialectPostgres = "postgres"
+)
+
+/*
+parseDSN picks the dialect and driver for a data source name by its scheme.
+postgres:// and postgresql:// URLs are handed to lib/pq as they are. Anything
+else is an SQLite database, either a plain path or a sqlite:// URL, opened
+with foreign keys enforced.
+*/
+func parseDSN(dsn string) (dialect, driver, source string) {
+	scheme, rest, ok := strings.Cut(dsn, "://")
+	if !ok {
+		return DialectSQLite, "sqlite3", withForeignKeys(dsn)
+	}
+	switch strings.ToLower(scheme) {
+	case "postgres", "postgresql":
+		return DialectPostgres, "postgres", dsn
+	case "sqlite", "sqlite3":
+		return DialectSQLite, "sqlite3", withForeignKeys(rest)
+	}
+	return "", "", ""
+}
+
+// withForeignKeys has the SQLite driver enable foreign keys on every
+// connection it opens, SQLite leaves them off unless asked per connection
+func withForeignKeys(source string) string {
+	separator := "?"
+	if strings.Contains(source, "?") {
+		separator = "&"
+	}
+	return source + separator + "_foreign_keys=on"
+}
+
+/*
+conn runs the queries of the Client, which are all written with SQLite's ?
+placeholders. For Postgres they are rewritten to $1, $2, ... on the way
+through, so every query is kept in a single version.
+*/
+type conn struct {
+	*sql.DB
+	dialect string
+}
+
+func (c conn) Exec(query string, args ...any) (sql.Result, error) {
+	return c.DB.Exec(c.rebind(query), args...)
+}
+
+func (c conn) Query(query string, args ...any) (*sql.Rows, error) {
+	return c.DB.Query(c.rebind(query), args...)
+}
+
+func (c conn) QueryRow(query string, args ...any) *sql.Row {
+	return c.DB.QueryRow(c.rebind(query), args...)
+}
+
+// rebind rewrites ? placeholders for the dialect, leaving quoted strings alone
+func (c conn) rebind(query string) string {
+	if c.dialect != DialectPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
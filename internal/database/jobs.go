@@ -0,0 +1,245 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Job is a unit of background work, claimed and run by a worker goroutine
+type Job struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Status    JobStatus `json:"status"`
+	Attempts  int       `json:"attempts"`
+	RunAt     time.Time `json:"run_at"`
+	LastError *string   `json:"last_error"`
+	CreateJobParams
+}
+
+type CreateJobParams struct {
+	Kind        string     `json:"kind"`
+	VideoID     *uuid.UUID `json:"video_id"`
+	Payload     string     `json:"payload"`
+	MaxAttempts int        `json:"max_attempts"`
+}
+
+type JobStatus string
+
+const (
+	JobStatusQueued  JobStatus = "queued"
+	JobStatusRunning JobStatus = "running"
+	JobStatusDone    JobStatus = "done"
+	JobStatusFailed  JobStatus = "failed"
+)
+
+const jobColumns = `id, created_at, updated_at, kind, video_id, payload, status, attempts, max_attempts, run_at, last_error`
+
+func (c Client) CreateJob(params CreateJobParams) (Job, error) {
+	id := uuid.New()
+	var videoID *string
+	if params.VideoID != nil {
+		s := params.VideoID.String()
+		videoID = &s
+	}
+	query := `
+	INSERT INTO jobs (
+		id,
+		created_at,
+		updated_at,
+		kind,
+		video_id,
+		payload,
+		status,
+		attempts,
+		max_attempts,
+		run_at
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, 0, ?, ?)
+	`
+	_, err := c.db.Exec(query, id.String(), params.Kind, videoID, params.Payload, JobStatusQueued, params.MaxAttempts, time.Now().UTC())
+	if err != nil {
+		return Job{}, err
+	}
+	return c.GetJob(id)
+}
+
+func (c Client) GetJob(id uuid.UUID) (Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE id = ?`
+	job, err := scanJob(c.db.QueryRow(query, id.String()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, nil
+		}
+		return Job{}, err
+	}
+	return job, nil
+}
+
+/*
+ClaimJob marks the oldest queued job that is due as running and returns it,
+incrementing its attempt count. It returns nil when there is nothing to do.
+*/
+func (c Client) ClaimJob(now time.Time) (*Job, error) {
+	query := `
+	UPDATE jobs
+	SET status = ?, attempts = attempts + 1, locked_at = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id FROM jobs
+		WHERE status = ? AND run_at <= ?
+		ORDER BY run_at
+		LIMIT 1` + c.claimLock() + `
+	) AND status = ?
+	RETURNING ` + jobColumns
+	job, err := scanJob(c.db.QueryRow(query, JobStatusRunning, now, JobStatusQueued, now, JobStatusQueued))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ErrJobClaimLost is returned when a job's outcome is recorded by a worker
+// whose claim was requeued and claimed again in the meantime
+var ErrJobClaimLost = errors.New("job was requeued and claimed again")
+
+/*
+CompleteJob, RetryJob and FailJob record the outcome of a claimed job.
+attempt is the job's attempt count when it was claimed, a later claim has a
+higher one, so a worker that overran its claim can't overwrite the state of
+the claim that replaced it. They return ErrJobClaimLost in that case.
+*/
+func (c Client) CompleteJob(id uuid.UUID, attempt int) error {
+	query := `
+	UPDATE jobs
+	SET status = ?, locked_at = NULL, last_error = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ? AND attempts = ?
+	`
+	return c.finishClaim(query, JobStatusDone, id.String(), JobStatusRunning, attempt)
+}
+
+// RetryJob puts a failed job back in the queue to run again at runAt
+func (c Client) RetryJob(id uuid.UUID, attempt int, lastError string, runAt time.Time) error {
+	query := `
+	UPDATE jobs
+	SET status = ?, locked_at = NULL, last_error = ?, run_at = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ? AND attempts = ?
+	`
+	return c.finishClaim(query, JobStatusQueued, lastError, runAt, id.String(), JobStatusRunning, attempt)
+}
+
+// FailJob gives up on a job for good
+func (c Client) FailJob(id uuid.UUID, attempt int, lastError string) error {
+	query := `
+	UPDATE jobs
+	SET status = ?, locked_at = NULL, last_error = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ? AND attempts = ?
+	`
+	return c.finishClaim(query, JobStatusFailed, lastError, id.String(), JobStatusRunning, attempt)
+}
+
+// finishClaim runs an update of a claimed job, returning ErrJobClaimLost if
+// the claim no longer holds
+func (c Client) finishClaim(query string, args ...any) error {
+	res, err := c.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	changed, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if changed == 0 {
+		return ErrJobClaimLost
+	}
+	return nil
+}
+
+/*
+RequeueStaleJobs puts jobs that have been running since before lockedBefore
+back in the queue. Workers that crash or are killed leave their jobs running.
+*/
+func (c Client) RequeueStaleJobs(lockedBefore time.Time) (int64, error) {
+	query := `
+	UPDATE jobs
+	SET status = ?, locked_at = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE status = ? AND locked_at < ?
+	`
+	res, err := c.db.Exec(query, JobStatusQueued, JobStatusRunning, lockedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// claimLock keeps app instances sharing a Postgres database from waiting on
+// each other's claims, SQLite serializes writes anyway
+func (c Client) claimLock() string {
+	if c.db.dialect == DialectPostgres {
+		return "\n\t\tFOR UPDATE SKIP LOCKED"
+	}
+	return ""
+}
+
+func scanJob(row rowScanner) (Job, error) {
+	var job Job
+	var id string
+	var videoID sql.NullString
+	err := row.Scan(
+		&id,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.Kind,
+		&videoID,
+		&job.Payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LastError,
+	)
+	if err != nil {
+		return Job{}, err
+	}
+	job.ID, err = uuid.Parse(id)
+	if err != nil {
+		return Job{}, err
+	}
+	if videoID.Valid {
+		parsed, err := uuid.Parse(videoID.String)
+		if err != nil {
+			return Job{}, err
+		}
+		job.VideoID = &parsed
+	}
+	return job, nil
+}
+
+// GetUnfinishedJobs returns the queued and running jobs of a kind
+func (c Client) GetUnfinishedJobs(kind string) ([]Job, error) {
+	query := `
+	SELECT ` + jobColumns + `
+	FROM jobs
+	WHERE kind = ? AND status IN (?, ?)
+	ORDER BY created_at
+	`
+	rows, err := c.db.Query(query, kind, JobStatusQueued, JobStatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
@@ -0,0 +1,390 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Migrations live in migrations/<dialect> as numbered pairs of files, e.g.
+0002_add_column.up.sql and 0002_add_column.down.sql. Both dialects carry the
+same versions so a version number means the same schema everywhere.
+*/
+//go:embed migrations
+var migrationFiles embed.FS
+
+// ErrSchemaTooNew is returned for databases migrated past the newest
+// migration this build knows, running against them could corrupt data
+var ErrSchemaTooNew = errors.New("database schema is newer than this version of tubely")
+
+// Migration is one numbered schema change
+type Migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+// MigrationStatus is a migration and when it was applied, if it was
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Arbitrary key for the Postgres advisory lock serializing migrations
+const migrationLockID = 7414596
+
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		name := entry.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("unexpected migration file %s", name)
+		}
+		number, title, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(number)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s isn't numbered: %w", name, err)
+		}
+		data, err := fs.ReadFile(migrationFiles, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: title}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.up = string(data)
+		} else {
+			m.down = string(data)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d needs both an up and a down file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func (c Client) ensureMigrationTable() error {
+	_, err := c.db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)
+	`)
+	return err
+}
+
+// appliedMigrations returns when each applied version was applied
+func (c Client) appliedMigrations() (map[int]time.Time, error) {
+	rows, err := c.db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// SchemaVersion returns the newest applied migration, 0 for an empty database
+func (c Client) SchemaVersion() (int, error) {
+	err := c.ensureMigrationTable()
+	if err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err = c.db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	return int(version.Int64), err
+}
+
+/*
+checkSchemaVersion returns ErrSchemaTooNew when the database has a migration
+applied that isn't embedded in this build
+*/
+func (c Client) checkSchemaVersion(migrations []Migration) error {
+	version, err := c.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].Version
+	}
+	if version > latest {
+		return fmt.Errorf("%w: database is at version %d, this build knows up to %d", ErrSchemaTooNew, version, latest)
+	}
+	return nil
+}
+
+// MigrateStatus lists every known migration and whether it has been applied
+func (c Client) MigrateStatus() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(c.db.dialect)
+	if err != nil {
+		return nil, err
+	}
+	err = c.ensureMigrationTable()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := c.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	for _, m := range migrations {
+		status := MigrationStatus{Migration: m}
+		if appliedAt, ok := applied[m.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, c.checkSchemaVersion(migrations)
+}
+
+/*
+MigrateUp applies every pending migration in order, each in its own
+transaction. Instances starting together on Postgres take turns, and a
+migration another instance got to first is skipped.
+It returns ErrSchemaTooNew without changing anything if the database is
+ahead of this build.
+*/
+func (c Client) MigrateUp() error {
+	migrations, err := loadMigrations(c.db.dialect)
+	if err != nil {
+		return err
+	}
+	err = c.checkSchemaVersion(migrations)
+	if err != nil {
+		return err
+	}
+	err = c.adoptLegacySchema()
+	if err != nil {
+		return fmt.Errorf("couldn't adopt existing schema: %w", err)
+	}
+
+	for _, m := range migrations {
+		err := c.inMigrationTx(func(tx *sql.Tx, applied bool) error {
+			if applied {
+				return nil
+			}
+			if _, err := tx.Exec(m.up); err != nil {
+				return err
+			}
+			_, err := tx.Exec(c.db.rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"), m.Version, time.Now().UTC())
+			return err
+		}, m.Version)
+		if err != nil {
+			return fmt.Errorf("couldn't apply migration %d %s: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// MigrateDown reverts the newest applied migration, it returns the
+// reverted migration or nil when there was nothing to revert
+func (c Client) MigrateDown() (*Migration, error) {
+	migrations, err := loadMigrations(c.db.dialect)
+	if err != nil {
+		return nil, err
+	}
+	err = c.checkSchemaVersion(migrations)
+	if err != nil {
+		return nil, err
+	}
+	version, err := c.SchemaVersion()
+	if err != nil || version == 0 {
+		return nil, err
+	}
+
+	for _, m := range migrations {
+		if m.Version != version {
+			continue
+		}
+		err := c.inMigrationTx(func(tx *sql.Tx, applied bool) error {
+			if !applied {
+				return nil
+			}
+			if _, err := tx.Exec(m.down); err != nil {
+				return err
+			}
+			_, err := tx.Exec(c.db.rebind("DELETE FROM schema_migrations WHERE version = ?"), m.Version)
+			return err
+		}, m.Version)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't revert migration %d %s: %w", m.Version, m.Name, err)
+		}
+		return &m, nil
+	}
+	return nil, fmt.Errorf("migration %d isn't known to this build", version)
+}
+
+/*
+inMigrationTx runs fn in a transaction holding the migration lock, telling
+it whether version is applied at that point. SQLite migrations rebuild
+tables, which only works with foreign keys off, so they run on a connection
+of their own with the keys checked before committing instead.
+*/
+func (c Client) inMigrationTx(fn func(tx *sql.Tx, applied bool) error, version int) error {
+	ctx := context.Background()
+	db, err := c.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if c.db.dialect == DialectSQLite {
+		// The pragma is a no-op inside a transaction, set it first
+		_, err = db.ExecContext(ctx, "PRAGMA foreign_keys = OFF")
+		if err != nil {
+			return err
+		}
+		defer db.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if c.db.dialect == DialectPostgres {
+		_, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID)
+		if err != nil {
+			return err
+		}
+	}
+	var count int
+	err = tx.QueryRow(c.db.rebind("SELECT COUNT(*) FROM schema_migrations WHERE version = ?"), version).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx, count > 0)
+	if err != nil {
+		return err
+	}
+	// Databases from before foreign keys were enforced may have dangling
+	// rows. They are reported rather than deleted, someone has to decide
+	// whether to remove them or restore their parents.
+	if c.db.dialect == DialectSQLite {
+		err = checkForeignKeys(tx)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// maxReportedViolations caps how many dangling rows an error lists
+const maxReportedViolations = 10
+
+// ErrForeignKeyViolations is returned when a migration would commit rows
+// referencing a parent that doesn't exist
+var ErrForeignKeyViolations = errors.New("rows reference missing parents")
+
+// checkForeignKeys returns ErrForeignKeyViolations listing the rows SQLite's
+// foreign_key_check reports, by table, rowid and missing parent table
+func checkForeignKeys(tx *sql.Tx) error {
+	rows, err := tx.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	violations := []string{}
+	for rows.Next() {
+		var table, parent string
+		var rowID sql.NullInt64
+		var fkID int
+		if err := rows.Scan(&table, &rowID, &parent, &fkID); err != nil {
+			return err
+		}
+		violations = append(violations, fmt.Sprintf("%s rowid %d references %s", table, rowID.Int64, parent))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	report := violations
+	if len(report) > maxReportedViolations {
+		report = append(report[:maxReportedViolations:maxReportedViolations], fmt.Sprintf("%d more", len(violations)-maxReportedViolations))
+	}
+	return fmt.Errorf("%w, delete or fix them and migrate again: %s", ErrForeignKeyViolations, strings.Join(report, "; "))
+}
+
+/*
+adoptLegacySchema brings an SQLite database created before versioned
+migrations up to what the initial migration creates. autoMigrate grew the
+videos table one column at a time, so older files lack some of them.
+Databases that have any migration applied are left alone.
+*/
+func (c Client) adoptLegacySchema() error {
+	if c.db.dialect != DialectSQLite {
+		return nil
+	}
+	version, err := c.SchemaVersion()
+	if err != nil || version > 0 {
+		return err
+	}
+	var tables int
+	err = c.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'videos'").Scan(&tables)
+	if err != nil || tables == 0 {
+		return err
+	}
+
+	for _, column := range []struct{ name, definition string }{
+		{"status", "TEXT NOT NULL DEFAULT ''"},
+		{"manifest_url", "TEXT"},
+		{"dash_manifest_url", "TEXT"},
+		{"outputs", "TEXT NOT NULL DEFAULT ''"},
+		{"preview_track_url", "TEXT"},
+		{"original_url", "TEXT"},
+		{"thumbnail_variants", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		err := c.addColumnIfMissing("videos", column.name, column.definition)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// A database from before foreign keys were enforced keeps its dangling rows
+// and stays on the old schema until someone deals with them
+func TestMigrateUpReportsDanglingRows(t *testing.T) {
+	c, err := NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Back to the schema from before foreign keys were enforced
+	for {
+		version, err := c.SchemaVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version == 1 {
+			break
+		}
+		_, err = c.MigrateDown()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	db, err := c.db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, "PRAGMA foreign_keys = OFF")
+	if err == nil {
+		_, err = db.ExecContext(ctx, "INSERT INTO videos (id, title, user_id) VALUES (?, 'Orphan', ?)", uuid.New(), uuid.New())
+	}
+	db.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.MigrateUp()
+	if !errors.Is(err, ErrForeignKeyViolations) || !strings.Contains(err.Error(), "videos rowid 1 references users") {
+		t.Fatalf("MigrateUp = %v, want the dangling video reported", err)
+	}
+	version, err := c.SchemaVersion()
+	if err != nil || version != 1 {
+		t.Errorf("version = %d, %v, want 1", version, err)
+	}
+	var count int
+	err = c.db.QueryRow("SELECT COUNT(*) FROM videos WHERE title = 'Orphan'").Scan(&count)
+	if err != nil || count != 1 {
+		t.Errorf("%d dangling videos left, %v, want the row kept", count, err)
+	}
+}
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS jobs;
+DROP TABLE IF EXISTS tus_uploads;
+DROP TABLE IF EXISTS video_media;
+DROP TABLE IF EXISTS videos;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,79 @@
+-- The SQLite schema with the types Postgres needs: user ids are TEXT so the
+-- foreign keys line up, sizes are BIGINT and timestamps keep their time zone.
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	password TEXT NOT NULL,
+	email TEXT UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token TEXT PRIMARY KEY,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	revoked_at TIMESTAMPTZ,
+	user_id TEXT NOT NULL REFERENCES users(id),
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS videos (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	title TEXT NOT NULL,
+	description TEXT,
+	thumbnail_url TEXT,
+	video_url TEXT,
+	user_id TEXT REFERENCES users(id),
+	status TEXT NOT NULL DEFAULT '',
+	manifest_url TEXT,
+	dash_manifest_url TEXT,
+	preview_track_url TEXT,
+	original_url TEXT,
+	thumbnail_variants TEXT NOT NULL DEFAULT '',
+	outputs TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS video_media (
+	video_id TEXT PRIMARY KEY REFERENCES videos(id) ON DELETE CASCADE,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	duration DOUBLE PRECISION NOT NULL DEFAULT 0,
+	width INTEGER NOT NULL DEFAULT 0,
+	height INTEGER NOT NULL DEFAULT 0,
+	video_codec TEXT NOT NULL DEFAULT '',
+	audio_codec TEXT NOT NULL DEFAULT '',
+	bitrate BIGINT NOT NULL DEFAULT 0,
+	frame_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
+	rotation INTEGER NOT NULL DEFAULT 0,
+	audio_channels INTEGER NOT NULL DEFAULT 0,
+	container TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS tus_uploads (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	video_id TEXT NOT NULL REFERENCES videos(id),
+	user_id TEXT NOT NULL REFERENCES users(id),
+	upload_length BIGINT NOT NULL,
+	upload_offset BIGINT NOT NULL DEFAULT 0,
+	metadata TEXT NOT NULL DEFAULT '',
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS jobs (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	kind TEXT NOT NULL,
+	video_id TEXT,
+	payload TEXT NOT NULL DEFAULT '{}',
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	max_attempts INTEGER NOT NULL,
+	run_at TIMESTAMPTZ NOT NULL,
+	locked_at TIMESTAMPTZ,
+	last_error TEXT
+);
+CREATE INDEX IF NOT EXISTS jobs_status_run_at ON jobs(status, run_at);
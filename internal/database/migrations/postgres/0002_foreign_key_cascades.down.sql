@@ -0,0 +1,12 @@
+ALTER TABLE refresh_tokens
+	DROP CONSTRAINT refresh_tokens_user_id_fkey,
+	ADD CONSTRAINT refresh_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id);
+ALTER TABLE videos
+	DROP CONSTRAINT videos_user_id_fkey,
+	ADD CONSTRAINT videos_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id);
+ALTER TABLE tus_uploads
+	DROP CONSTRAINT tus_uploads_video_id_fkey,
+	ADD CONSTRAINT tus_uploads_video_id_fkey FOREIGN KEY (video_id) REFERENCES videos(id);
+ALTER TABLE tus_uploads
+	DROP CONSTRAINT tus_uploads_user_id_fkey,
+	ADD CONSTRAINT tus_uploads_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id);
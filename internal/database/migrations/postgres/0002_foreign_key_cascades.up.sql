@@ -0,0 +1,14 @@
+-- Deleting a user removes their videos and sessions, and deleting a video
+-- its unfinished uploads. The column types were right from the start here.
+ALTER TABLE refresh_tokens
+	DROP CONSTRAINT refresh_tokens_user_id_fkey,
+	ADD CONSTRAINT refresh_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE videos
+	DROP CONSTRAINT videos_user_id_fkey,
+	ADD CONSTRAINT videos_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE tus_uploads
+	DROP CONSTRAINT tus_uploads_video_id_fkey,
+	ADD CONSTRAINT tus_uploads_video_id_fkey FOREIGN KEY (video_id) REFERENCES videos(id) ON DELETE CASCADE;
+ALTER TABLE tus_uploads
+	DROP CONSTRAINT tus_uploads_user_id_fkey,
+	ADD CONSTRAINT tus_uploads_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
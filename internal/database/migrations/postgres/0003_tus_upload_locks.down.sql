@@ -0,0 +1,3 @@
+ALTER TABLE tus_uploads
+	DROP COLUMN locked_until,
+	DROP COLUMN lock_token;
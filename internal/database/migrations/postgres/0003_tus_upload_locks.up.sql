@@ -0,0 +1,5 @@
+-- tus uploads can be written by any instance sharing the database, a PATCH
+-- holds a lease on its upload's row instead of an in-process lock.
+ALTER TABLE tus_uploads
+	ADD COLUMN lock_token TEXT,
+	ADD COLUMN locked_until TIMESTAMPTZ;
@@ -0,0 +1,86 @@
+-- The schema autoMigrate used to create. Every statement is IF NOT EXISTS so
+-- databases from before versioned migrations are adopted, adoptLegacySchema
+-- adds the columns older versions of autoMigrate didn't have.
+
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	password TEXT NOT NULL,
+	email TEXT UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	revoked_at TIMESTAMP,
+	user_id TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS videos (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	title TEXT NOT NULL,
+	description TEXT,
+	thumbnail_url TEXT,
+	video_url TEXT TEXT,
+	user_id INTEGER,
+	status TEXT NOT NULL DEFAULT '',
+	manifest_url TEXT,
+	dash_manifest_url TEXT,
+	preview_track_url TEXT,
+	original_url TEXT,
+	thumbnail_variants TEXT NOT NULL DEFAULT '',
+	outputs TEXT NOT NULL DEFAULT '',
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS video_media (
+	video_id TEXT PRIMARY KEY,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	duration REAL NOT NULL DEFAULT 0,
+	width INTEGER NOT NULL DEFAULT 0,
+	height INTEGER NOT NULL DEFAULT 0,
+	video_codec TEXT NOT NULL DEFAULT '',
+	audio_codec TEXT NOT NULL DEFAULT '',
+	bitrate INTEGER NOT NULL DEFAULT 0,
+	frame_rate REAL NOT NULL DEFAULT 0,
+	rotation INTEGER NOT NULL DEFAULT 0,
+	audio_channels INTEGER NOT NULL DEFAULT 0,
+	container TEXT NOT NULL DEFAULT '',
+	FOREIGN KEY(video_id) REFERENCES videos(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS tus_uploads (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	video_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	upload_length INTEGER NOT NULL,
+	upload_offset INTEGER NOT NULL DEFAULT 0,
+	metadata TEXT NOT NULL DEFAULT '',
+	expires_at TIMESTAMP NOT NULL,
+	FOREIGN KEY(video_id) REFERENCES videos(id),
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS jobs (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	kind TEXT NOT NULL,
+	video_id TEXT,
+	payload TEXT NOT NULL DEFAULT '{}',
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	max_attempts INTEGER NOT NULL,
+	run_at TIMESTAMP NOT NULL,
+	locked_at TIMESTAMP,
+	last_error TEXT
+);
+CREATE INDEX IF NOT EXISTS jobs_status_run_at ON jobs(status, run_at);
@@ -0,0 +1,61 @@
+-- videos.user_id was declared INTEGER while users.id is a TEXT uuid, and
+-- foreign keys were never enforced, so deleting a user left its videos
+-- behind. SQLite can't alter columns or constraints, the tables are rebuilt.
+-- The migration runs with foreign keys off so dropping the old tables
+-- doesn't cascade, and they are checked before it commits. Rows whose parent
+-- is already gone fail that check and are listed in the error.
+
+CREATE TABLE videos_new (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	title TEXT NOT NULL,
+	description TEXT,
+	thumbnail_url TEXT,
+	video_url TEXT,
+	user_id TEXT,
+	status TEXT NOT NULL DEFAULT '',
+	manifest_url TEXT,
+	dash_manifest_url TEXT,
+	preview_track_url TEXT,
+	original_url TEXT,
+	thumbnail_variants TEXT NOT NULL DEFAULT '',
+	outputs TEXT NOT NULL DEFAULT '',
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+INSERT INTO videos_new (id, created_at, updated_at, title, description, thumbnail_url, video_url, user_id, status, manifest_url, dash_manifest_url, preview_track_url, original_url, thumbnail_variants, outputs)
+SELECT id, created_at, updated_at, title, description, thumbnail_url, video_url, user_id, status, manifest_url, dash_manifest_url, preview_track_url, original_url, thumbnail_variants, outputs FROM videos;
+DROP TABLE videos;
+ALTER TABLE videos_new RENAME TO videos;
+
+CREATE TABLE refresh_tokens_new (
+	token TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	revoked_at TIMESTAMP,
+	user_id TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+INSERT INTO refresh_tokens_new (token, created_at, updated_at, revoked_at, user_id, expires_at)
+SELECT token, created_at, updated_at, revoked_at, user_id, expires_at FROM refresh_tokens;
+DROP TABLE refresh_tokens;
+ALTER TABLE refresh_tokens_new RENAME TO refresh_tokens;
+
+CREATE TABLE tus_uploads_new (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	video_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	upload_length INTEGER NOT NULL,
+	upload_offset INTEGER NOT NULL DEFAULT 0,
+	metadata TEXT NOT NULL DEFAULT '',
+	expires_at TIMESTAMP NOT NULL,
+	FOREIGN KEY(video_id) REFERENCES videos(id) ON DELETE CASCADE,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+INSERT INTO tus_uploads_new (id, created_at, updated_at, video_id, user_id, upload_length, upload_offset, metadata, expires_at)
+SELECT id, created_at, updated_at, video_id, user_id, upload_length, upload_offset, metadata, expires_at FROM tus_uploads;
+DROP TABLE tus_uploads;
+ALTER TABLE tus_uploads_new RENAME TO tus_uploads;
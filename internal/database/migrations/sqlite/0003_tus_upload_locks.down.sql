@@ -0,0 +1,2 @@
+ALTER TABLE tus_uploads DROP COLUMN locked_until;
+ALTER TABLE tus_uploads DROP COLUMN lock_token;
@@ -0,0 +1,241 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TusUpload tracks a resumable upload of a video file
+type TusUpload struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Offset    int64     `json:"upload_offset"`
+	CreateTusUploadParams
+}
+
+type CreateTusUploadParams struct {
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Length    int64     `json:"upload_length"`
+	Metadata  string    `json:"metadata"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (c Client) CreateTusUpload(params CreateTusUploadParams) (TusUpload, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO tus_uploads (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		upload_length,
+		upload_offset,
+		metadata,
+		expires_at
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, 0, ?, ?)
+	`
+	_, err := c.db.Exec(query, id.String(), params.VideoID.String(), params.UserID.String(), params.Length, params.Metadata, params.ExpiresAt)
+	if err != nil {
+		return TusUpload{}, err
+	}
+
+	return c.GetTusUpload(id)
+}
+
+// GetTusUpload returns the upload with the given ID, or a zero TusUpload if it doesn't exist
+func (c Client) GetTusUpload(id uuid.UUID) (TusUpload, error) {
+	query := `
+	SELECT id, created_at, updated_at, video_id, user_id, upload_length, upload_offset, metadata, expires_at
+	FROM tus_uploads
+	WHERE id = ?
+	`
+	upload, err := scanTusUpload(c.db.QueryRow(query, id.String()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return TusUpload{}, nil
+		}
+		return TusUpload{}, err
+	}
+	return upload, nil
+}
+
+// GetExpiredTusUploads returns the uploads that expired before now
+func (c Client) GetExpiredTusUploads(now time.Time) ([]TusUpload, error) {
+	query := `
+	SELECT id, created_at, updated_at, video_id, user_id, upload_length, upload_offset, metadata, expires_at
+	FROM tus_uploads
+	WHERE expires_at < ?
+	`
+	rows, err := c.db.Query(query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []TusUpload{}
+	for rows.Next() {
+		upload, err := scanTusUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+// GetTusUploadsForVideo returns the unfinished uploads of a video
+func (c Client) GetTusUploadsForVideo(videoID uuid.UUID) ([]TusUpload, error) {
+	query := `
+	SELECT id, created_at, updated_at, video_id, user_id, upload_length, upload_offset, metadata, expires_at
+	FROM tus_uploads
+	WHERE video_id = ?
+	`
+	rows, err := c.db.Query(query, videoID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []TusUpload{}
+	for rows.Next() {
+		upload, err := scanTusUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+// GetTusUploads returns every unfinished upload
+func (c Client) GetTusUploads() ([]TusUpload, error) {
+	query := `
+	SELECT id, created_at, updated_at, video_id, user_id, upload_length, upload_offset, metadata, expires_at
+	FROM tus_uploads
+	`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []TusUpload{}
+	for rows.Next() {
+		upload, err := scanTusUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+// ErrTusUploadLockLost is returned when an upload is written under a lock
+// that expired and was taken by another request
+var ErrTusUploadLockLost = errors.New("upload lock was lost")
+
+/*
+LockTusUpload takes the write lock of an upload until until, unless another
+token holds it past now. Calling it again with the same token extends the
+lock. It reports whether the token holds the lock.
+*/
+func (c Client) LockTusUpload(id uuid.UUID, token string, now, until time.Time) (bool, error) {
+	query := `
+	UPDATE tus_uploads
+	SET lock_token = ?, locked_until = ?
+	WHERE id = ? AND (lock_token IS NULL OR lock_token = ? OR locked_until < ?)
+	`
+	res, err := c.db.Exec(query, token, until, id.String(), token, now)
+	if err != nil {
+		return false, err
+	}
+	changed, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return changed == 1, nil
+}
+
+// UnlockTusUpload releases the lock if token still holds it
+func (c Client) UnlockTusUpload(id uuid.UUID, token string) error {
+	query := `
+	UPDATE tus_uploads
+	SET lock_token = NULL, locked_until = NULL
+	WHERE id = ? AND lock_token = ?
+	`
+	_, err := c.db.Exec(query, id.String(), token)
+	return err
+}
+
+// UpdateTusUploadOffset saves how much of an upload has been stored. It
+// returns ErrTusUploadLockLost unless token holds the upload's lock.
+func (c Client) UpdateTusUploadOffset(id uuid.UUID, token string, offset int64, expiresAt time.Time) error {
+	query := `
+	UPDATE tus_uploads
+	SET upload_offset = ?, expires_at = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND lock_token = ?
+	`
+	res, err := c.db.Exec(query, offset, expiresAt, id.String(), token)
+	if err != nil {
+		return err
+	}
+	changed, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if changed == 0 {
+		return ErrTusUploadLockLost
+	}
+	return nil
+}
+
+func (c Client) DeleteTusUpload(id uuid.UUID) error {
+	query := `
+	DELETE FROM tus_uploads
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id.String())
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTusUpload(row rowScanner) (TusUpload, error) {
+	var upload TusUpload
+	var id, videoID, userID string
+	err := row.Scan(
+		&id,
+		&upload.CreatedAt,
+		&upload.UpdatedAt,
+		&videoID,
+		&userID,
+		&upload.Length,
+		&upload.Offset,
+		&upload.Metadata,
+		&upload.ExpiresAt,
+	)
+	if err != nil {
+		return TusUpload{}, err
+	}
+	upload.ID, err = uuid.Parse(id)
+	if err != nil {
+		return TusUpload{}, err
+	}
+	upload.VideoID, err = uuid.Parse(videoID)
+	if err != nil {
+		return TusUpload{}, err
+	}
+	upload.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return TusUpload{}, err
+	}
+	return upload, nil
+}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoMedia is what ffprobe reported about a processed video file
+type VideoMedia struct {
+	VideoID       uuid.UUID `json:"-"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Duration      float64   `json:"duration"`
+	Width         int       `json:"width"`
+	Height        int       `json:"height"`
+	VideoCodec    string    `json:"video_codec"`
+	AudioCodec    string    `json:"audio_codec"`
+	Bitrate       int64     `json:"bitrate"`
+	FrameRate     float64   `json:"frame_rate"`
+	Rotation      int       `json:"rotation"`
+	AudioChannels int       `json:"audio_channels"`
+	Container     string    `json:"container"`
+}
+
+// UpsertVideoMedia saves the media metadata of a video, replacing any earlier probe
+func (c Client) UpsertVideoMedia(media VideoMedia) error {
+	query := `
+	INSERT INTO video_media (
+		video_id,
+		updated_at,
+		duration,
+		width,
+		height,
+		video_codec,
+		audio_codec,
+		bitrate,
+		frame_rate,
+		rotation,
+		audio_channels,
+		container
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(video_id) DO UPDATE SET
+		updated_at = CURRENT_TIMESTAMP,
+		duration = excluded.duration,
+		width = excluded.width,
+		height = excluded.height,
+		video_codec = excluded.video_codec,
+		audio_codec = excluded.audio_codec,
+		bitrate = excluded.bitrate,
+		frame_rate = excluded.frame_rate,
+		rotation = excluded.rotation,
+		audio_channels = excluded.audio_channels,
+		container = excluded.container
+	`
+	_, err := c.db.Exec(
+		query,
+		media.VideoID,
+		media.Duration,
+		media.Width,
+		media.Height,
+		media.VideoCodec,
+		media.AudioCodec,
+		media.Bitrate,
+		media.FrameRate,
+		media.Rotation,
+		media.AudioChannels,
+		media.Container,
+	)
+	return err
+}
+
+// GetVideoMedia returns the media metadata of a video, or a zero VideoMedia if it hasn't been probed
+func (c Client) GetVideoMedia(videoID uuid.UUID) (VideoMedia, error) {
+	query := `
+	SELECT
+		video_id,
+		updated_at,
+		duration,
+		width,
+		height,
+		video_codec,
+		audio_codec,
+		bitrate,
+		frame_rate,
+		rotation,
+		audio_channels,
+		container
+	FROM video_media
+	WHERE video_id = ?
+	`
+
+	var media VideoMedia
+	err := c.db.QueryRow(query, videoID).Scan(
+		&media.VideoID,
+		&media.UpdatedAt,
+		&media.Duration,
+		&media.Width,
+		&media.Height,
+		&media.VideoCodec,
+		&media.AudioCodec,
+		&media.Bitrate,
+		&media.FrameRate,
+		&media.Rotation,
+		&media.AudioChannels,
+		&media.Container,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoMedia{}, nil
+		}
+		return VideoMedia{}, err
+	}
+	return media, nil
+}
@@ -2,28 +2,205 @@ package database
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// Video is a row of the videos table. ThumbnailURL, VideoURL, ManifestURL,
+// DashManifestURL, PreviewTrackURL and OriginalURL hold storage keys, the API
+// turns them into URLs when responding.
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID              uuid.UUID         `json:"id"`
+	CreatedAt       time.Time         `json:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+	ThumbnailURL    *string           `json:"thumbnail_url"`
+	VideoURL        *string           `json:"video_url"`
+	ManifestURL     *string           `json:"manifest_url"`
+	DashManifestURL *string           `json:"dash_manifest_url"`
+	PreviewTrackURL *string           `json:"preview_track_url"`
+	OriginalURL     *string           `json:"original_url,omitempty"`
+	Thumbnails      ThumbnailVariants `json:"thumbnails,omitempty"`
+	Outputs         VideoOutputs      `json:"outputs"`
+	Status          VideoStatus       `json:"status,omitempty"`
+	// Media isn't a column, handlers fill it in from the video_media table
+	Media *VideoMedia `json:"media,omitempty"`
 	CreateVideoParams
 }
 
+// VideoStatus tracks an uploaded video file through processing
+type VideoStatus string
+
+const (
+	VideoStatusUploaded   VideoStatus = "uploaded"
+	VideoStatusProcessing VideoStatus = "processing"
+	VideoStatusReady      VideoStatus = "ready"
+	VideoStatusFailed     VideoStatus = "failed"
+)
+
+// VideoOutputs is the set of formats a video was published in
+type VideoOutputs []string
+
+const (
+	VideoOutputMP4  = "mp4"
+	VideoOutputHLS  = "hls"
+	VideoOutputDASH = "dash"
+)
+
+// Scan reads the comma separated list stored in the outputs column
+func (o *VideoOutputs) Scan(src any) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("can't scan %T into VideoOutputs", src)
+	}
+	*o = VideoOutputs{}
+	if s != "" {
+		*o = strings.Split(s, ",")
+	}
+	return nil
+}
+
+func (o VideoOutputs) Value() (driver.Value, error) {
+	return strings.Join(o, ","), nil
+}
+
+// ThumbnailVariants maps an image format to its sizes by srcset width
+// descriptor, e.g. {"webp": {"1280w": key}}. Like the URL columns it holds
+// storage keys until the API resolves them.
+type ThumbnailVariants map[string]map[string]string
+
+// Scan reads the JSON object stored in the thumbnail_variants column
+func (t *ThumbnailVariants) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("can't scan %T into ThumbnailVariants", src)
+	}
+	*t = nil
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, t)
+}
+
+func (t ThumbnailVariants) Value() (driver.Value, error) {
+	if len(t) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
 type CreateVideoParams struct {
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
 	UserID      uuid.UUID `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+// VideoFilter narrows a video listing by media metadata, zero fields match everything.
+// Videos that haven't been probed only match an empty filter.
+type VideoFilter struct {
+	MinDuration float64
+	MaxDuration float64
+	MinHeight   int
+	MaxHeight   int
+	VideoCodec  string
+	AudioCodec  string
+	Container   string
+}
+
+func (c Client) GetVideos(userID uuid.UUID, filter VideoFilter) ([]Video, error) {
+	query := `
+	SELECT
+		videos.id,
+		videos.created_at,
+		videos.updated_at,
+		videos.title,
+		videos.description,
+		videos.thumbnail_url,
+		videos.video_url,
+		videos.user_id,
+		videos.status,
+		videos.manifest_url,
+		videos.dash_manifest_url,
+		videos.preview_track_url,
+		videos.original_url,
+		videos.thumbnail_variants,
+		videos.outputs
+	FROM videos
+	LEFT JOIN video_media ON video_media.video_id = videos.id
+	WHERE videos.user_id = ?
+	`
+	args := []any{userID}
+	if filter.MinDuration > 0 {
+		query += " AND video_media.duration >= ?"
+		args = append(args, filter.MinDuration)
+	}
+	if filter.MaxDuration > 0 {
+		query += " AND video_media.duration <= ?"
+		args = append(args, filter.MaxDuration)
+	}
+	if filter.MinHeight > 0 {
+		query += " AND video_media.height >= ?"
+		args = append(args, filter.MinHeight)
+	}
+	if filter.MaxHeight > 0 {
+		query += " AND video_media.height <= ?"
+		args = append(args, filter.MaxHeight)
+	}
+	if filter.VideoCodec != "" {
+		query += " AND video_media.video_codec = ?"
+		args = append(args, filter.VideoCodec)
+	}
+	if filter.AudioCodec != "" {
+		query += " AND video_media.audio_codec = ?"
+		args = append(args, filter.AudioCodec)
+	}
+	if filter.Container != "" {
+		query += " AND video_media.container = ?"
+		args = append(args, filter.Container)
+	}
+	query += " ORDER BY videos.created_at DESC"
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, nil
+}
+
+// GetAllVideos returns the videos of every user, oldest first
+func (c Client) GetAllVideos() ([]Video, error) {
 	query := `
 	SELECT
 		id,
@@ -33,13 +210,18 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
-		user_id
+		user_id,
+		status,
+		manifest_url,
+		dash_manifest_url,
+		preview_track_url,
+		original_url,
+		thumbnail_variants,
+		outputs
 	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
+	ORDER BY created_at
 	`
-
-	rows, err := c.db.Query(query, userID)
+	rows, err := c.db.Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -47,23 +229,35 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
 	}
+	return videos, rows.Err()
+}
 
-	return videos, nil
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.UserID,
+		&video.Status,
+		&video.ManifestURL,
+		&video.DashManifestURL,
+		&video.PreviewTrackURL,
+		&video.OriginalURL,
+		&video.Thumbnails,
+		&video.Outputs,
+	)
+	return video, err
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
@@ -96,7 +290,14 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
-		user_id
+		user_id,
+		status,
+		manifest_url,
+		dash_manifest_url,
+		preview_track_url,
+		original_url,
+		thumbnail_variants,
+		outputs
 	FROM videos
 	WHERE id = ?
 	`
@@ -110,7 +311,14 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 		&video.Description,
 		&video.ThumbnailURL,
 		&video.VideoURL,
-		&video.UserID)
+		&video.UserID,
+		&video.Status,
+		&video.ManifestURL,
+		&video.DashManifestURL,
+		&video.PreviewTrackURL,
+		&video.OriginalURL,
+		&video.Thumbnails,
+		&video.Outputs)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -129,7 +337,15 @@ func (c Client) UpdateVideo(video Video) error {
 		description = ?,
 		thumbnail_url = ?,
 		video_url = ?,
-		user_id = ?
+		user_id = ?,
+		status = ?,
+		manifest_url = ?,
+		dash_manifest_url = ?,
+		preview_track_url = ?,
+		original_url = ?,
+		thumbnail_variants = ?,
+		outputs = ?,
+		updated_at = CURRENT_TIMESTAMP
 	WHERE id = ?
 	`
 
@@ -140,16 +356,58 @@ func (c Client) UpdateVideo(video Video) error {
 		&video.ThumbnailURL,
 		&video.VideoURL,
 		video.UserID,
+		video.Status,
+		&video.ManifestURL,
+		&video.DashManifestURL,
+		&video.PreviewTrackURL,
+		&video.OriginalURL,
+		video.Thumbnails,
+		video.Outputs,
 		video.ID,
 	)
 	return err
 }
 
+func (c Client) UpdateVideoStatus(id uuid.UUID, status VideoStatus) error {
+	query := `
+	UPDATE videos
+	SET status = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, id)
+	return err
+}
+
+// StartVideoProcessing sets a video's status to processing unless an upload
+// of it is already uploaded or processing. It reports whether it did, so of
+// two concurrent callers only one gets true.
+func (c Client) StartVideoProcessing(id uuid.UUID) (bool, error) {
+	query := `
+	UPDATE videos
+	SET status = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status NOT IN (?, ?)
+	`
+	result, err := c.db.Exec(query, VideoStatusProcessing, id, VideoStatusUploaded, VideoStatusProcessing)
+	if err != nil {
+		return false, err
+	}
+	changed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return changed == 1, nil
+}
+
 func (c Client) DeleteVideo(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM video_media WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	_, err = c.db.Exec(query, id)
 	return err
 }
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// CloudFrontSigner signs URLs and cookies for a CloudFront distribution
+// that only serves content to trusted key groups.
+// See https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/PrivateContent.html
+type CloudFrontSigner struct {
+	baseURL      string
+	keyPairID    string
+	privateKey   *rsa.PrivateKey
+	ttl          time.Duration
+	cookieDomain string
+	useCookies   bool
+	now          func() time.Time
+}
+
+// CloudFrontPolicy describes who may fetch a resource and when. An empty
+// NotBefore and SourceIP together with a resource without wildcards is a
+// canned policy, anything else is signed as a custom policy.
+type CloudFrontPolicy struct {
+	Resource  string
+	Expires   time.Time
+	NotBefore time.Time
+	SourceIP  string
+}
+
+type CloudFrontSignerOptions struct {
+	Domain     string
+	KeyPairID  string
+	PrivateKey *rsa.PrivateKey
+	TTL        time.Duration
+	// UseCookies makes BuildURL return unsigned URLs. Access is granted by
+	// the cookies from SignedCookies instead, which suits HLS playlists
+	// where the player fetches many segment URLs.
+	UseCookies   bool
+	CookieDomain string
+}
+
+func NewCloudFrontSigner(opts CloudFrontSignerOptions) *CloudFrontSigner {
+	return &CloudFrontSigner{
+		baseURL:      strings.TrimSuffix(CDNBaseURL(opts.Domain), "/"),
+		keyPairID:    opts.KeyPairID,
+		privateKey:   opts.PrivateKey,
+		ttl:          opts.TTL,
+		cookieDomain: opts.CookieDomain,
+		useCookies:   opts.UseCookies,
+		now:          time.Now,
+	}
+}
+
+// ParseCloudFrontPrivateKey parses a PEM encoded PKCS#1 or PKCS#8 RSA key
+func ParseCloudFrontPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM block found in private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+func (s *CloudFrontSigner) BuildURL(ctx context.Context, key string) (string, error) {
+	rawURL := s.baseURL + "/" + key
+	if s.useCookies {
+		return rawURL, nil
+	}
+	return s.SignURL(rawURL, CloudFrontPolicy{
+		Resource: rawURL,
+		Expires:  s.now().Add(s.ttl),
+	})
+}
+
+// SignURL adds the Expires or Policy, Signature and Key-Pair-Id query
+// parameters to rawURL
+func (s *CloudFrontSigner) SignURL(rawURL string, policy CloudFrontPolicy) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	policyJSON, err := policy.marshal()
+	if err != nil {
+		return "", err
+	}
+	signature, err := s.sign(policyJSON)
+	if err != nil {
+		return "", err
+	}
+
+	params := []string{}
+	if u.RawQuery != "" {
+		params = append(params, u.RawQuery)
+	}
+	if policy.isCanned() {
+		params = append(params, fmt.Sprintf("Expires=%d", policy.Expires.Unix()))
+	} else {
+		params = append(params, "Policy="+cloudFrontEncode(policyJSON))
+	}
+	params = append(params,
+		"Signature="+signature,
+		"Key-Pair-Id="+s.keyPairID,
+	)
+	u.RawQuery = strings.Join(params, "&")
+	return u.String(), nil
+}
+
+/*
+SignedCookies returns the CloudFront-Policy, CloudFront-Signature and
+CloudFront-Key-Pair-Id cookies that grant access to every object sharing
+key's base name, e.g. "landscape/abc.mp4" and "landscape/abc/hls/720p.m3u8".
+*/
+func (s *CloudFrontSigner) SignedCookies(key string) ([]*http.Cookie, error) {
+	expires := s.now().Add(s.ttl)
+	policy := CloudFrontPolicy{
+		Resource: s.baseURL + "/" + strings.TrimSuffix(key, path.Ext(key)) + "*",
+		Expires:  expires,
+	}
+	policyJSON, err := policy.marshal()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := s.sign(policyJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []struct{ name, value string }{
+		{"CloudFront-Policy", cloudFrontEncode(policyJSON)},
+		{"CloudFront-Signature", signature},
+		{"CloudFront-Key-Pair-Id", s.keyPairID},
+	}
+	cookies := make([]*http.Cookie, 0, len(values))
+	for _, v := range values {
+		cookies = append(cookies, &http.Cookie{
+			Name:     v.name,
+			Value:    v.value,
+			Domain:   s.cookieDomain,
+			Path:     "/",
+			Expires:  expires,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteNoneMode,
+		})
+	}
+	return cookies, nil
+}
+
+func (s *CloudFrontSigner) sign(policy []byte) (string, error) {
+	hash := sha1.Sum(policy)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.privateKey, crypto.SHA1, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("couldn't sign policy: %w", err)
+	}
+	return cloudFrontEncode(signature), nil
+}
+
+func (p CloudFrontPolicy) isCanned() bool {
+	return p.NotBefore.IsZero() && p.SourceIP == "" && !strings.Contains(p.Resource, "*")
+}
+
+// marshal renders the policy the way CloudFront expects it, without any
+// whitespace and with the statement fields in a fixed order
+func (p CloudFrontPolicy) marshal() ([]byte, error) {
+	type epoch struct {
+		EpochTime int64 `json:"AWS:EpochTime"`
+	}
+	type sourceIP struct {
+		SourceIP string `json:"AWS:SourceIp"`
+	}
+	type condition struct {
+		DateLessThan    epoch     `json:"DateLessThan"`
+		DateGreaterThan *epoch    `json:"DateGreaterThan,omitempty"`
+		IPAddress       *sourceIP `json:"IpAddress,omitempty"`
+	}
+	type statement struct {
+		Resource  string    `json:"Resource"`
+		Condition condition `json:"Condition"`
+	}
+	type policy struct {
+		Statement []statement `json:"Statement"`
+	}
+
+	cond := condition{
+		DateLessThan: epoch{p.Expires.Unix()},
+	}
+	if !p.NotBefore.IsZero() {
+		cond.DateGreaterThan = &epoch{p.NotBefore.Unix()}
+	}
+	if p.SourceIP != "" {
+		cond.IPAddress = &sourceIP{p.SourceIP}
+	}
+
+	// json.Marshal would escape characters that are common in URLs
+	var buf strings.Builder
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(policy{
+		Statement: []statement{{Resource: p.Resource, Condition: cond}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimSuffix(buf.String(), "\n")), nil
+}
+
+// cloudFrontEncode is base64 with the characters that are invalid in
+// query strings and cookies swapped out, as CloudFront requires
+func cloudFrontEncode(b []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(b))
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func newTestSigner(t *testing.T, useCookies bool) (*CloudFrontSigner, *rsa.PublicKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := NewCloudFrontSigner(CloudFrontSignerOptions{
+		Domain:       "d111111abcdef8.cloudfront.net",
+		KeyPairID:    "K2JCJMDEHXQW5F",
+		PrivateKey:   key,
+		TTL:          15 * time.Minute,
+		UseCookies:   useCookies,
+		CookieDomain: ".example.com",
+	})
+	signer.now = func() time.Time { return testNow }
+	return signer, &key.PublicKey
+}
+
+// cloudFrontDecode reverses cloudFrontEncode
+func cloudFrontDecode(t *testing.T, s string) []byte {
+	t.Helper()
+	if strings.ContainsAny(s, "+=/") {
+		t.Errorf("%q isn't CloudFront URL-safe base64", s)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(s))
+	if err != nil {
+		t.Fatalf("decoding %q: %v", s, err)
+	}
+	return data
+}
+
+func verifySignature(t *testing.T, pub *rsa.PublicKey, policy []byte, signature string) {
+	t.Helper()
+	hash := sha1.Sum(policy)
+	err := rsa.VerifyPKCS1v15(pub, crypto.SHA1, hash[:], cloudFrontDecode(t, signature))
+	if err != nil {
+		t.Errorf("signature doesn't verify for policy %s: %v", policy, err)
+	}
+}
+
+func TestCloudFrontCannedPolicy(t *testing.T) {
+	signer, pub := newTestSigner(t, false)
+	signed, err := signer.BuildURL(context.Background(), "landscape/abc.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resource := "https://d111111abcdef8.cloudfront.net/landscape/abc.mp4"
+	if got := u.Scheme + "://" + u.Host + u.Path; got != resource {
+		t.Errorf("URL = %q, want %q", got, resource)
+	}
+	query := u.Query()
+	expires := testNow.Add(15 * time.Minute).Unix()
+	if got := query.Get("Expires"); got != fmt.Sprint(expires) {
+		t.Errorf("Expires = %q, want %d", got, expires)
+	}
+	if got := query.Get("Key-Pair-Id"); got != "K2JCJMDEHXQW5F" {
+		t.Errorf("Key-Pair-Id = %q", got)
+	}
+	if query.Has("Policy") {
+		t.Error("canned policy URL has a Policy parameter")
+	}
+
+	policy := fmt.Sprintf(`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`, resource, expires)
+	verifySignature(t, pub, []byte(policy), query.Get("Signature"))
+}
+
+func TestCloudFrontCustomPolicy(t *testing.T) {
+	signer, pub := newTestSigner(t, false)
+	rawURL := "https://d111111abcdef8.cloudfront.net/landscape/abc.mp4?v=2"
+	signed, err := signer.SignURL(rawURL, CloudFrontPolicy{
+		Resource:  "https://d111111abcdef8.cloudfront.net/landscape/*",
+		Expires:   testNow.Add(time.Hour),
+		NotBefore: testNow,
+		SourceIP:  "192.0.2.0/24",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("v") != "2" {
+		t.Errorf("existing query parameters were dropped: %q", u.RawQuery)
+	}
+	if query.Has("Expires") {
+		t.Error("custom policy URL has an Expires parameter")
+	}
+	if got := query.Get("Key-Pair-Id"); got != "K2JCJMDEHXQW5F" {
+		t.Errorf("Key-Pair-Id = %q", got)
+	}
+
+	policy := cloudFrontDecode(t, query.Get("Policy"))
+	want := fmt.Sprintf(`{"Statement":[{"Resource":"https://d111111abcdef8.cloudfront.net/landscape/*","Condition":{"DateLessThan":{"AWS:EpochTime":%d},"DateGreaterThan":{"AWS:EpochTime":%d},"IpAddress":{"AWS:SourceIp":"192.0.2.0/24"}}}]}`,
+		testNow.Add(time.Hour).Unix(), testNow.Unix())
+	if string(policy) != want {
+		t.Errorf("Policy =\n%s\nwant\n%s", policy, want)
+	}
+	verifySignature(t, pub, policy, query.Get("Signature"))
+}
+
+func TestCloudFrontSignedCookies(t *testing.T) {
+	signer, pub := newTestSigner(t, true)
+
+	// Cookie mode hands out plain URLs
+	plain, err := signer.BuildURL(context.Background(), "landscape/abc.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain != "https://d111111abcdef8.cloudfront.net/landscape/abc.mp4" {
+		t.Errorf("BuildURL = %q, want an unsigned URL", plain)
+	}
+
+	cookies, err := signer.SignedCookies("landscape/abc.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]*http.Cookie{}
+	for _, cookie := range cookies {
+		byName[cookie.Name] = cookie
+		if cookie.Domain != ".example.com" || cookie.Path != "/" || !cookie.Secure || !cookie.HttpOnly {
+			t.Errorf("cookie %s = %+v", cookie.Name, cookie)
+		}
+		if !cookie.Expires.Equal(testNow.Add(15 * time.Minute)) {
+			t.Errorf("cookie %s expires %s", cookie.Name, cookie.Expires)
+		}
+	}
+	for _, name := range []string{"CloudFront-Policy", "CloudFront-Signature", "CloudFront-Key-Pair-Id"} {
+		if byName[name] == nil {
+			t.Fatalf("missing cookie %s, got %v", name, cookies)
+		}
+	}
+	if got := byName["CloudFront-Key-Pair-Id"].Value; got != "K2JCJMDEHXQW5F" {
+		t.Errorf("CloudFront-Key-Pair-Id = %q", got)
+	}
+
+	policy := cloudFrontDecode(t, byName["CloudFront-Policy"].Value)
+	want := fmt.Sprintf(`{"Statement":[{"Resource":"https://d111111abcdef8.cloudfront.net/landscape/abc*","Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`,
+		testNow.Add(15*time.Minute).Unix())
+	if string(policy) != want {
+		t.Errorf("CloudFront-Policy =\n%s\nwant\n%s", policy, want)
+	}
+	verifySignature(t, pub, policy, byName["CloudFront-Signature"].Value)
+}
+
+func TestParseCloudFrontPrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, block := range map[string]*pem.Block{
+		"pkcs1": {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+		"pkcs8": {Type: "PRIVATE KEY", Bytes: pkcs8},
+	} {
+		parsed, err := ParseCloudFrontPrivateKey(pem.EncodeToMemory(block))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !parsed.Equal(key) {
+			t.Errorf("%s: parsed a different key", name)
+		}
+	}
+	if _, err := ParseCloudFrontPrivateKey([]byte("not a key")); err == nil {
+		t.Error("parsing garbage succeeded")
+	}
+}
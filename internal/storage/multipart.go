@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3 refuses parts smaller than 5 MiB (except the last one) and uploads
+// with more than 10,000 parts
+const (
+	minPartSize = 5 << 20
+	maxParts    = 10000
+)
+
+// MultipartOptions controls how S3Store splits large objects into parts
+type MultipartOptions struct {
+	// PartSize is the size of every part but the last, objects smaller
+	// than one part are sent with a single PutObject
+	PartSize int64
+	// Concurrency is the number of parts uploaded at the same time
+	Concurrency int
+	// MaxRetries is how many times a failed part is retried
+	MaxRetries int
+}
+
+func DefaultMultipartOptions() MultipartOptions {
+	return MultipartOptions{
+		PartSize:    16 << 20,
+		Concurrency: 4,
+		MaxRetries:  3,
+	}
+}
+
+func (o MultipartOptions) withDefaults() MultipartOptions {
+	defaults := DefaultMultipartOptions()
+	if o.PartSize < minPartSize {
+		o.PartSize = minPartSize
+	}
+	if o.Concurrency < 1 {
+		o.Concurrency = defaults.Concurrency
+	}
+	if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	return o
+}
+
+/*
+putMultipart streams body to S3 in parts. Parts are read one at a time and
+uploaded by up to Concurrency goroutines, each retried with backoff. If any
+part fails the multipart upload is aborted so S3 doesn't keep (and bill for)
+the parts that did make it.
+*/
+func (s *S3Store) putMultipart(ctx context.Context, key string, body io.Reader, contentType string, firstPart []byte) error {
+	opts := s.multipart
+
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key),
+		ContentType:       aws.String(contentType),
+		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't start multipart upload of %s: %w", key, err)
+	}
+	uploadID := created.UploadId
+
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		parts    []types.CompletedPart
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	sem := make(chan struct{}, opts.Concurrency)
+
+	part := firstPart
+	for partNumber := int32(1); ; partNumber++ {
+		if partNumber > maxParts {
+			fail(fmt.Errorf("%s needs more than %d parts, increase the part size", key, maxParts))
+			break
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-uploadCtx.Done():
+		}
+		if uploadCtx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(partNumber int32, data []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			completed, err := s.uploadPart(uploadCtx, key, uploadID, partNumber, data)
+			if err != nil {
+				fail(err)
+				return
+			}
+			mu.Lock()
+			parts = append(parts, completed)
+			mu.Unlock()
+		}(partNumber, part)
+
+		part, err = readPart(body, opts.PartSize)
+		if err != nil {
+			fail(fmt.Errorf("couldn't read %s: %w", key, err))
+			break
+		}
+		if len(part) == 0 {
+			break
+		}
+	}
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		s.abortMultipart(ctx, key, uploadID)
+		return firstErr
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.ToInt32(parts[i].PartNumber) < aws.ToInt32(parts[j].PartNumber)
+	})
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		s.abortMultipart(ctx, key, uploadID)
+		return fmt.Errorf("couldn't complete multipart upload of %s: %w", key, err)
+	}
+	return nil
+}
+
+// uploadPart uploads a single part, retrying with exponential backoff
+func (s *S3Store) uploadPart(ctx context.Context, key string, uploadID *string, partNumber int32, data []byte) (types.CompletedPart, error) {
+	backoff := 500 * time.Millisecond
+	var err error
+	for attempt := 0; attempt <= s.multipart.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-ctx.Done():
+				return types.CompletedPart{}, ctx.Err()
+			}
+		}
+
+		var out *s3.UploadPartOutput
+		out, err = s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:            aws.String(s.bucket),
+			Key:               aws.String(key),
+			UploadId:          uploadID,
+			PartNumber:        aws.Int32(partNumber),
+			Body:              bytes.NewReader(data),
+			ContentLength:     aws.Int64(int64(len(data))),
+			ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
+		})
+		if err == nil {
+			return types.CompletedPart{
+				PartNumber:    aws.Int32(partNumber),
+				ETag:          out.ETag,
+				ChecksumCRC32: out.ChecksumCRC32,
+			}, nil
+		}
+		if ctx.Err() != nil {
+			return types.CompletedPart{}, ctx.Err()
+		}
+	}
+	return types.CompletedPart{}, fmt.Errorf("couldn't upload part %d of %s: %w", partNumber, key, err)
+}
+
+// abortMultipart discards the parts of a failed upload. It runs even when
+// ctx was cancelled, otherwise the parts would stay in the bucket.
+func (s *S3Store) abortMultipart(ctx context.Context, key string, uploadID *string) {
+	abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	_, err := s.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		log.Printf("Couldn't abort multipart upload of %s: %v", key, err)
+	}
+}
+
+// Smallest buffer readPart starts with, grown as the body turns out longer
+const minPartBuffer = 64 << 10
+
+/*
+readPart reads up to size bytes, returning fewer only at the end of r. The
+buffer starts small and doubles up to size, so a small thumbnail or HLS
+segment doesn't cost a whole part's worth of memory.
+*/
+func readPart(r io.Reader, size int64) ([]byte, error) {
+	buf := make([]byte, 0, min(size, minPartBuffer))
+	for int64(len(buf)) < size {
+		if len(buf) == cap(buf) {
+			grown := make([]byte, len(buf), min(size, int64(cap(buf))*2))
+			copy(grown, buf)
+			buf = grown
+		}
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if errors.Is(err, io.EOF) {
+			return buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadPart(t *testing.T) {
+	const size = 1 << 20
+	tests := []struct {
+		name    string
+		length  int
+		wantLen int
+	}{
+		{"empty", 0, 0},
+		{"small", 100, 100},
+		{"larger than the first buffer", minPartBuffer + 1, minPartBuffer + 1},
+		{"exactly one part", size, size},
+		{"more than one part", size + 10, size},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := bytes.Repeat([]byte("x"), tt.length)
+			// Short reads must not end the part early
+			r := iotest.HalfReader(bytes.NewReader(body))
+			part, err := readPart(r, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(part) != tt.wantLen {
+				t.Errorf("len = %d, want %d", len(part), tt.wantLen)
+			}
+			if cap(part) > size {
+				t.Errorf("cap = %d, more than the part size", cap(part))
+			}
+			if tt.length < minPartBuffer && cap(part) > minPartBuffer {
+				t.Errorf("cap = %d for a %d byte body", cap(part), tt.length)
+			}
+		})
+	}
+
+	_, err := readPart(iotest.ErrReader(io.ErrClosedPipe), size)
+	if !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("error = %v, want the reader's error", err)
+	}
+}
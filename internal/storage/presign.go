@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// PresignedURLBuilder signs a short-lived GET URL for every key, so the
+// bucket itself can stay private
+type PresignedURLBuilder struct {
+	presignClient *s3.PresignClient
+	bucket        string
+	ttl           time.Duration
+}
+
+func NewPresignedURLBuilder(client *s3.Client, bucket string, ttl time.Duration) *PresignedURLBuilder {
+	return &PresignedURLBuilder{
+		presignClient: s3.NewPresignClient(client),
+		bucket:        bucket,
+		ttl:           ttl,
+	}
+}
+
+func (p *PresignedURLBuilder) BuildURL(ctx context.Context, key string) (string, error) {
+	req, err := p.presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(p.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(p.ttl))
+	if err != nil {
+		return "", fmt.Errorf("couldn't presign %s: %w", key, err)
+	}
+	return req.URL, nil
+}
+
+// PresignedUpload tells a browser how to upload a file straight to S3.
+// PUT uploads send the file as the request body with Headers set, POST
+// uploads send a multipart form with Fields followed by a "file" field.
+type PresignedUpload struct {
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Key       string            `json:"key"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// UploadPresigner issues presigned PUT requests and POST policies for a bucket
+type UploadPresigner struct {
+	presignClient *s3.PresignClient
+	bucket        string
+	ttl           time.Duration
+}
+
+func NewUploadPresigner(client *s3.Client, bucket string, ttl time.Duration) *UploadPresigner {
+	return &UploadPresigner{
+		presignClient: s3.NewPresignClient(client),
+		bucket:        bucket,
+		ttl:           ttl,
+	}
+}
+
+// PresignGet signs a GET URL for an uploaded object, so tools like ffprobe
+// can read it without credentials
+func (p *UploadPresigner) PresignGet(ctx context.Context, key string) (string, error) {
+	req, err := p.presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(p.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(p.ttl))
+	if err != nil {
+		return "", fmt.Errorf("couldn't presign %s: %w", key, err)
+	}
+	return req.URL, nil
+}
+
+// PresignPut signs a PUT request that only accepts a body of exactly size
+// bytes with the given content type
+func (p *UploadPresigner) PresignPut(ctx context.Context, key, contentType string, size int64) (PresignedUpload, error) {
+	req, err := p.presignClient.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(p.bucket),
+		Key:           aws.String(key),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(size),
+	}, s3.WithPresignExpires(p.ttl))
+	if err != nil {
+		return PresignedUpload{}, fmt.Errorf("couldn't presign upload of %s: %w", key, err)
+	}
+
+	// Browsers set Host and Content-Length themselves
+	headers := map[string]string{}
+	for name, values := range req.SignedHeader {
+		if len(values) == 0 || strings.EqualFold(name, "Host") || strings.EqualFold(name, "Content-Length") {
+			continue
+		}
+		headers[name] = values[0]
+	}
+
+	return PresignedUpload{
+		Method:    req.Method,
+		URL:       req.URL,
+		Key:       key,
+		Headers:   headers,
+		ExpiresAt: time.Now().UTC().Add(p.ttl),
+	}, nil
+}
+
+// PresignPost creates a POST policy that only accepts files of up to maxSize
+// bytes with the given content type
+func (p *UploadPresigner) PresignPost(ctx context.Context, key, contentType string, maxSize int64) (PresignedUpload, error) {
+	req, err := p.presignClient.PresignPostObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(p.bucket),
+		Key:    aws.String(key),
+	}, func(opts *s3.PresignPostOptions) {
+		opts.Expires = p.ttl
+		opts.Conditions = []interface{}{
+			[]interface{}{"content-length-range", 1, maxSize},
+			map[string]string{"Content-Type": contentType},
+		}
+	})
+	if err != nil {
+		return PresignedUpload{}, fmt.Errorf("couldn't presign upload of %s: %w", key, err)
+	}
+
+	fields := map[string]string{
+		"Content-Type": contentType,
+	}
+	for name, value := range req.Values {
+		fields[name] = value
+	}
+
+	return PresignedUpload{
+		Method:    http.MethodPost,
+		URL:       req.URL,
+		Key:       key,
+		Fields:    fields,
+		ExpiresAt: time.Now().UTC().Add(p.ttl),
+	}, nil
+}
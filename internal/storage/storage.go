@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when a key doesn't exist in a store
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a single stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// BlobStore is the storage backend used for thumbnails and videos.
+// Keys are slash separated paths relative to the root of the store,
+// e.g. "landscape/abc123.mp4".
+type BlobStore interface {
+	// Put stores the contents of body under key, replacing any existing object
+	Put(ctx context.Context, key string, body io.Reader, contentType string) error
+	// Get opens the object stored under key. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	// Stat returns the metadata of the object stored under key
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// List returns every object whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// URL returns the public URL the object can be fetched from
+	URL(key string) string
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testBlobStore checks the behaviour every BlobStore has to share
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+
+	put := func(key, body string) {
+		t.Helper()
+		err := store.Put(ctx, key, strings.NewReader(body), "image/png")
+		if err != nil {
+			t.Fatalf("Put(%q) error = %v", key, err)
+		}
+	}
+	get := func(key string) string {
+		t.Helper()
+		rc, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Get(%q) error = %v", key, err)
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("reading %q: %v", key, err)
+		}
+		return string(data)
+	}
+
+	t.Run("put and get", func(t *testing.T) {
+		put("thumbnails/a.png", "first")
+		if got := get("thumbnails/a.png"); got != "first" {
+			t.Errorf("Get = %q, want %q", got, "first")
+		}
+		put("thumbnails/a.png", "second")
+		if got := get("thumbnails/a.png"); got != "second" {
+			t.Errorf("Get after overwrite = %q, want %q", got, "second")
+		}
+	})
+
+	t.Run("stat", func(t *testing.T) {
+		put("thumbnails/b.png", "12345")
+		info, err := store.Stat(ctx, "thumbnails/b.png")
+		if err != nil {
+			t.Fatalf("Stat error = %v", err)
+		}
+		if info.Key != "thumbnails/b.png" || info.Size != 5 || info.ContentType != "image/png" {
+			t.Errorf("Stat = %+v, want key thumbnails/b.png, size 5, image/png", info)
+		}
+		if info.LastModified.IsZero() {
+			t.Error("Stat LastModified is zero")
+		}
+	})
+
+	t.Run("missing keys", func(t *testing.T) {
+		_, err := store.Get(ctx, "missing.png")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get error = %v, want ErrNotFound", err)
+		}
+		_, err = store.Stat(ctx, "missing.png")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat error = %v, want ErrNotFound", err)
+		}
+		err = store.Delete(ctx, "missing.png")
+		if err != nil {
+			t.Errorf("Delete of a missing key error = %v, want nil", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		put("thumbnails/c.png", "gone soon")
+		err := store.Delete(ctx, "thumbnails/c.png")
+		if err != nil {
+			t.Fatalf("Delete error = %v", err)
+		}
+		_, err = store.Stat(ctx, "thumbnails/c.png")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat after Delete error = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		put("landscape/x.png", "x")
+		put("landscape/x/hls/master.png", "m")
+		put("portrait/y.png", "y")
+
+		objects, err := store.List(ctx, "landscape/")
+		if err != nil {
+			t.Fatalf("List error = %v", err)
+		}
+		keys := []string{}
+		for _, object := range objects {
+			keys = append(keys, object.Key)
+		}
+		sort.Strings(keys)
+		want := []string{"landscape/x.png", "landscape/x/hls/master.png"}
+		if strings.Join(keys, ",") != strings.Join(want, ",") {
+			t.Errorf("List(landscape/) = %v, want %v", keys, want)
+		}
+
+		objects, err = store.List(ctx, "nothing-here/")
+		if err != nil || len(objects) != 0 {
+			t.Errorf("List of an empty prefix = %v, %v, want no objects", objects, err)
+		}
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testBlobStore(t, NewMemoryStore("http://localhost/assets"))
+}
+
+func TestLocalStore(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir(), "http://localhost/assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+
+	if got := store.URL("a/b.png"); got != "http://localhost/assets/a/b.png" {
+		t.Errorf("URL = %q", got)
+	}
+	err = store.Put(context.Background(), "../escape.png", strings.NewReader("x"), "image/png")
+	if err == nil {
+		t.Error("Put outside the root succeeded")
+	}
+}
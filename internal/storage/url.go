@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// URLBuilder turns a stored key into the URL clients fetch it from.
+// Builders that sign URLs do so on every call, so the result should be
+// handed to the client right away rather than stored.
+type URLBuilder interface {
+	BuildURL(ctx context.Context, key string) (string, error)
+}
+
+// BaseURLBuilder serves keys below a fixed base URL, e.g. a CloudFront
+// distribution or the local /assets route
+type BaseURLBuilder struct {
+	baseURL string
+}
+
+func NewBaseURLBuilder(baseURL string) BaseURLBuilder {
+	return BaseURLBuilder{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+func (b BaseURLBuilder) URL(key string) string {
+	return b.baseURL + "/" + key
+}
+
+func (b BaseURLBuilder) BuildURL(ctx context.Context, key string) (string, error) {
+	return b.URL(key), nil
+}
+
+// OriginURLBuilder serves keys from the store that holds them
+func OriginURLBuilder(store BlobStore) URLBuilder {
+	return originURLBuilder{store}
+}
+
+type originURLBuilder struct {
+	store BlobStore
+}
+
+func (o originURLBuilder) BuildURL(ctx context.Context, key string) (string, error) {
+	return o.store.URL(key), nil
+}
+
+// S3BaseURL returns the virtual-hosted style URL of a bucket
+func S3BaseURL(bucket, region string) string {
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, region)
+}
+
+// CDNBaseURL returns the URL of a CloudFront distribution domain. The domain
+// may be given with or without a scheme.
+func CDNBaseURL(domain string) string {
+	if strings.HasPrefix(domain, "http://") || strings.HasPrefix(domain, "https://") {
+		return domain
+	}
+	return "https://" + domain
+}
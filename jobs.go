@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Kinds of background jobs
+const (
+	jobKindProcessVideo = "process_video"
+	jobKindDeleteAssets = "delete_assets"
+)
+
+const (
+	jobMaxAttempts   = 5
+	jobPollInterval  = 5 * time.Second
+	jobTimeout       = time.Hour
+	jobRetryBackoff  = 30 * time.Second
+	jobMaxRetryDelay = 30 * time.Minute
+	// Claims older than this are requeued. It's well past jobTimeout, so a
+	// job finishing right at its deadline can still record how it went.
+	jobStaleAfter = 2 * jobTimeout
+)
+
+// processVideoPayload points a process_video job at the uploaded file,
+// either a file on local disk or an object staged in the video store
+type processVideoPayload struct {
+	SourcePath string `json:"source_path,omitempty"`
+	StagingKey string `json:"staging_key,omitempty"`
+}
+
+// enqueueJob saves a job and wakes up an idle worker to run it
+func (cfg *apiConfig) enqueueJob(kind string, videoID *uuid.UUID, payload any) (database.Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return database.Job{}, err
+	}
+	job, err := cfg.db.CreateJob(database.CreateJobParams{
+		Kind:        kind,
+		VideoID:     videoID,
+		Payload:     string(data),
+		MaxAttempts: jobMaxAttempts,
+	})
+	if err != nil {
+		return database.Job{}, err
+	}
+
+	select {
+	case cfg.jobWake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+/*
+enqueueVideoProcessing marks a video as uploaded and queues the job that
+processes it. The job owns the payload's file or staged object from here on.
+With a database several instances share, any of them may claim the job, so
+a file on local disk is staged in the video store first and removed.
+*/
+func (cfg *apiConfig) enqueueVideoProcessing(ctx context.Context, video database.Video, payload processVideoPayload) (database.Video, error) {
+	staged := false
+	if payload.SourcePath != "" && cfg.db.Dialect() != database.DialectSQLite {
+		key, err := cfg.stageLocalUpload(ctx, video.ID, payload.SourcePath)
+		if err != nil {
+			return database.Video{}, fmt.Errorf("couldn't stage upload: %w", err)
+		}
+		os.Remove(payload.SourcePath)
+		payload = processVideoPayload{StagingKey: key}
+		staged = true
+	}
+
+	// Set the status first so a fast worker can't have it overwritten
+	err := cfg.db.UpdateVideoStatus(video.ID, database.VideoStatusUploaded)
+	if err == nil {
+		_, err = cfg.enqueueJob(jobKindProcessVideo, &video.ID, payload)
+	}
+	if err != nil {
+		if staged {
+			deleteAsset(ctx, cfg.videoStore, payload.StagingKey)
+		}
+		return database.Video{}, err
+	}
+	video.Status = database.VideoStatusUploaded
+	return video, nil
+}
+
+// stageLocalUpload puts an upload on local disk in the video store next to
+// direct uploads and returns its key
+func (cfg *apiConfig) stageLocalUpload(ctx context.Context, videoID uuid.UUID, sourcePath string) (string, error) {
+	file, err := os.Open(sourcePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	contentType, err := sniffReader(file)
+	if err != nil {
+		return "", err
+	}
+	extension, ok := videoFormats[contentType]
+	if !ok {
+		return "", fmt.Errorf("%s isn't an accepted video", sourcePath)
+	}
+	key, err := randomAssetKey(path.Join(directUploadPrefix, videoID.String()), extension)
+	if err != nil {
+		return "", err
+	}
+	err = cfg.videoStore.Put(ctx, key, file, contentType)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+/*
+startJobWorkers starts n goroutines that claim and run queued jobs until ctx
+is cancelled. Jobs left running by a previous process are requeued first,
+and from then on periodically, so jobs of a worker or instance that died
+are picked up again without waiting for a restart.
+*/
+func (cfg *apiConfig) startJobWorkers(ctx context.Context, n int) error {
+	err := cfg.requeueStaleJobs()
+	if err != nil {
+		return err
+	}
+	go cfg.runStaleJobRequeue(ctx, jobStaleAfter/8)
+
+	for i := 0; i < n; i++ {
+		go cfg.runJobWorker(ctx)
+	}
+	return nil
+}
+
+// requeueStaleJobs queues jobs again that have been running for well over
+// the time a job may run, whoever claimed them isn't working on them anymore
+func (cfg *apiConfig) requeueStaleJobs() error {
+	requeued, err := cfg.db.RequeueStaleJobs(time.Now().UTC().Add(-jobStaleAfter))
+	if err != nil {
+		return err
+	}
+	if requeued > 0 {
+		log.Printf("Requeued %d stale jobs", requeued)
+		select {
+		case cfg.jobWake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (cfg *apiConfig) runStaleJobRequeue(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := cfg.requeueStaleJobs()
+		if err != nil {
+			log.Printf("Couldn't requeue stale jobs: %v", err)
+		}
+	}
+}
+
+func (cfg *apiConfig) runJobWorker(ctx context.Context) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		// Drain the queue before waiting again
+		for {
+			job, err := cfg.db.ClaimJob(time.Now().UTC())
+			if err != nil {
+				log.Printf("Couldn't claim job: %v", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			cfg.runJob(ctx, *job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-cfg.jobWake:
+		}
+	}
+}
+
+// runJob runs a claimed job and records the outcome, scheduling a retry with
+// exponential backoff until the job runs out of attempts
+func (cfg *apiConfig) runJob(ctx context.Context, job database.Job) {
+	jobCtx, cancel := context.WithTimeout(ctx, jobTimeout)
+	defer cancel()
+
+	var err error
+	switch job.Kind {
+	case jobKindProcessVideo:
+		err = cfg.runProcessVideoJob(jobCtx, job)
+	case jobKindDeleteAssets:
+		err = cfg.runDeleteAssetsJob(jobCtx, job)
+	default:
+		err = fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+
+	if err == nil {
+		err = cfg.db.CompleteJob(job.ID, job.Attempts)
+		if err != nil {
+			log.Printf("Couldn't complete job %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	log.Printf("Job %s (%s) attempt %d failed: %v", job.ID, job.Kind, job.Attempts, err)
+	if job.Attempts < job.MaxAttempts {
+		delay := jobRetryBackoff << (job.Attempts - 1)
+		if delay > jobMaxRetryDelay || delay <= 0 {
+			delay = jobMaxRetryDelay
+		}
+		err = cfg.db.RetryJob(job.ID, job.Attempts, err.Error(), time.Now().UTC().Add(delay))
+		if err != nil {
+			log.Printf("Couldn't reschedule job %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	err = cfg.db.FailJob(job.ID, job.Attempts, err.Error())
+	if errors.Is(err, database.ErrJobClaimLost) {
+		// Another worker is running the job again, its files are still needed
+		log.Printf("Couldn't fail job %s: %v", job.ID, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Couldn't fail job %s: %v", job.ID, err)
+	}
+	cfg.jobFailed(ctx, job)
+}
+
+// jobFailed cleans up after a job that won't be retried
+func (cfg *apiConfig) jobFailed(ctx context.Context, job database.Job) {
+	switch job.Kind {
+	case jobKindProcessVideo:
+		if job.VideoID != nil {
+			err := cfg.db.UpdateVideoStatus(*job.VideoID, database.VideoStatusFailed)
+			if err != nil {
+				log.Printf("Couldn't mark video %s as failed: %v", job.VideoID, err)
+			}
+			cfg.progress.publish(*job.VideoID, progressEvent{
+				Stage:   progressStageFailed,
+				Message: "Video processing failed",
+			})
+		}
+		var payload processVideoPayload
+		if json.Unmarshal([]byte(job.Payload), &payload) != nil {
+			return
+		}
+		if payload.SourcePath != "" {
+			os.Remove(payload.SourcePath)
+		}
+		if payload.StagingKey != "" {
+			err := deleteAsset(ctx, cfg.videoStore, payload.StagingKey)
+			if err != nil {
+				log.Printf("Couldn't delete staged upload of failed job %s: %v", job.ID, err)
+			}
+		}
+	}
+}
+
+func (cfg *apiConfig) runProcessVideoJob(ctx context.Context, job database.Job) error {
+	var payload processVideoPayload
+	err := json.Unmarshal([]byte(job.Payload), &payload)
+	if err != nil {
+		return err
+	}
+	if job.VideoID == nil {
+		return errors.New("job has no video")
+	}
+
+	video, err := cfg.db.GetVideo(*job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		// The video was deleted while it was queued, nothing left to do
+		if payload.SourcePath != "" {
+			os.Remove(payload.SourcePath)
+		}
+		if payload.StagingKey != "" {
+			return deleteAsset(ctx, cfg.videoStore, payload.StagingKey)
+		}
+		return nil
+	}
+
+	err = cfg.db.UpdateVideoStatus(video.ID, database.VideoStatusProcessing)
+	if err != nil {
+		return err
+	}
+
+	// Everything processing writes goes in a workspace that's removed
+	// however the job ends
+	size, err := cfg.sourceSize(ctx, payload)
+	if err != nil {
+		return err
+	}
+	ws, err := cfg.newWorkspace(size * workspaceSizeFactor)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	sourcePath := payload.SourcePath
+	if payload.StagingKey != "" {
+		// Download the staged video into the workspace
+		sourcePath = ws.path("source" + path.Ext(payload.StagingKey))
+		err = cfg.downloadStagedVideo(ctx, payload.StagingKey, sourcePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = cfg.processVideoUpload(ctx, ws, video, sourcePath)
+	if err != nil {
+		return err
+	}
+
+	// The processed copy is stored, the original isn't needed anymore
+	if payload.SourcePath != "" {
+		os.Remove(payload.SourcePath)
+	}
+	if payload.StagingKey != "" {
+		err = cfg.videoStore.Delete(ctx, payload.StagingKey)
+		if err != nil {
+			log.Printf("Couldn't delete staged upload %s: %v", payload.StagingKey, err)
+		}
+	}
+	return nil
+}
+
+// downloadStagedVideo copies a staged upload from the video store to dest
+func (cfg *apiConfig) downloadStagedVideo(ctx context.Context, key, dest string) error {
+	staged, err := cfg.videoStore.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer staged.Close()
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, staged)
+	return err
+}
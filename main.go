@@ -2,16 +2,20 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 )
 
 type apiConfig struct {
@@ -24,18 +28,46 @@ type apiConfig struct {
 	s3Region         string
 	s3CfDistribution string
 	port             string
-	s3Client         *s3.Client
+	videoStore       storage.BlobStore
+	thumbnailStore   storage.BlobStore
+	videoURLs        storage.URLBuilder
+	thumbnailURLs    storage.URLBuilder
+	uploadPresigner  *storage.UploadPresigner
+	tusDir           string
+	tusExpiration    time.Duration
+	uploadDir        string
+	scratchMinFree   int64
+	jobWake          chan struct{}
+	progress         *progressBroker
+	hlsEnabled       bool
+	dashEnabled      bool
+	archiveOriginals bool
+
+	autoThumbnail        string
+	autoThumbnailPercent int
+	previewInterval      time.Duration
+
+	media MediaProcessor
 }
 
 func main() {
 	godotenv.Load(".env")
 
-	pathToDB := os.Getenv("DB_PATH")
-	if pathToDB == "" {
-		log.Fatal("DB_URL must be set")
+	// DB_URL selects the database by scheme, DB_PATH is an SQLite file
+	dsn := os.Getenv("DB_URL")
+	if dsn == "" {
+		dsn = os.Getenv("DB_PATH")
+	}
+	if dsn == "" {
+		log.Fatal("DB_URL or DB_PATH must be set")
+	}
+
+	// Migrations run before anything else is set up, the schema may be broken
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrateCommand(dsn, os.Args[2:]))
 	}
 
-	db, err := database.NewClient(pathToDB)
+	db, err := database.NewClient(dsn)
 	if err != nil {
 		log.Fatalf("Couldn't connect to database: %v", err)
 	}
@@ -80,6 +112,148 @@ func main() {
 		log.Fatal("PORT environment variable is not set")
 	}
 
+	videoStorage := os.Getenv("VIDEO_STORAGE")
+	if videoStorage == "" {
+		videoStorage = storageBackendS3
+	}
+
+	thumbnailStorage := os.Getenv("THUMBNAIL_STORAGE")
+	if thumbnailStorage == "" {
+		thumbnailStorage = storageBackendLocal
+	}
+
+	videoURLMode := os.Getenv("VIDEO_URL_MODE")
+	if videoURLMode == "" {
+		videoURLMode = urlModeCDN
+	}
+
+	thumbnailURLMode := os.Getenv("THUMBNAIL_URL_MODE")
+	if thumbnailURLMode == "" {
+		thumbnailURLMode = urlModeOrigin
+	}
+
+	multipart := storage.DefaultMultipartOptions()
+	if partSize := os.Getenv("S3_PART_SIZE_MB"); partSize != "" {
+		megabytes, err := strconv.ParseInt(partSize, 10, 64)
+		if err != nil {
+			log.Fatalf("S3_PART_SIZE_MB is not a number: %v", err)
+		}
+		multipart.PartSize = megabytes << 20
+	}
+	if concurrency := os.Getenv("S3_UPLOAD_CONCURRENCY"); concurrency != "" {
+		multipart.Concurrency, err = strconv.Atoi(concurrency)
+		if err != nil {
+			log.Fatalf("S3_UPLOAD_CONCURRENCY is not a number: %v", err)
+		}
+	}
+	if retries := os.Getenv("S3_PART_RETRIES"); retries != "" {
+		multipart.MaxRetries, err = strconv.Atoi(retries)
+		if err != nil {
+			log.Fatalf("S3_PART_RETRIES is not a number: %v", err)
+		}
+	}
+
+	uploadDir := os.Getenv("UPLOAD_DIR")
+	if uploadDir == "" {
+		uploadDir = filepath.Join(os.TempDir(), "tubely-uploads")
+	}
+
+	scratchMinFree := int64(1024)
+	if minFree := os.Getenv("SCRATCH_MIN_FREE_MB"); minFree != "" {
+		scratchMinFree, err = strconv.ParseInt(minFree, 10, 64)
+		if err != nil {
+			log.Fatalf("SCRATCH_MIN_FREE_MB is not a number: %v", err)
+		}
+	}
+
+	jobWorkers := 2
+	if workers := os.Getenv("JOB_WORKERS"); workers != "" {
+		jobWorkers, err = strconv.Atoi(workers)
+		if err != nil {
+			log.Fatalf("JOB_WORKERS is not a number: %v", err)
+		}
+	}
+
+	hlsEnabled := os.Getenv("HLS_ENABLED") != "false"
+	dashEnabled := os.Getenv("DASH_ENABLED") == "true"
+	archiveOriginals := os.Getenv("ARCHIVE_ORIGINALS") == "true"
+
+	autoThumbnail := os.Getenv("AUTO_THUMBNAIL")
+	if autoThumbnail == "" {
+		autoThumbnail = autoThumbnailPercent
+	}
+	if autoThumbnail != autoThumbnailOff && autoThumbnail != autoThumbnailPercent && autoThumbnail != autoThumbnailScene {
+		log.Fatalf("AUTO_THUMBNAIL must be %s, %s or %s", autoThumbnailOff, autoThumbnailPercent, autoThumbnailScene)
+	}
+
+	thumbnailPercent := 10
+	if percent := os.Getenv("AUTO_THUMBNAIL_PERCENT"); percent != "" {
+		thumbnailPercent, err = strconv.Atoi(percent)
+		if err != nil || thumbnailPercent < 0 || thumbnailPercent > 100 {
+			log.Fatalf("AUTO_THUMBNAIL_PERCENT must be between 0 and 100")
+		}
+	}
+
+	tusDir := os.Getenv("TUS_DIR")
+	if tusDir == "" {
+		tusDir = filepath.Join(os.TempDir(), "tubely-tus")
+	}
+
+	tusExpiration := 24 * time.Hour
+	if expiration := os.Getenv("TUS_EXPIRATION"); expiration != "" {
+		tusExpiration, err = time.ParseDuration(expiration)
+		if err != nil {
+			log.Fatalf("TUS_EXPIRATION is not a valid duration: %v", err)
+		}
+	}
+
+	media, err := newExecMediaProcessor()
+	if err != nil {
+		log.Fatalf("Couldn't set up media processing: %v", err)
+	}
+
+	previewInterval := 5 * time.Second
+	if interval := os.Getenv("PREVIEW_INTERVAL"); interval != "" {
+		previewInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalf("PREVIEW_INTERVAL is not a valid duration: %v", err)
+		}
+	}
+
+	// Playlists, manifests and preview tracks point at their files by
+	// relative URL, which only a signed cookie covers
+	if videoURLMode == urlModePresign || videoURLMode == urlModeCDNSigned {
+		if hlsEnabled || dashEnabled || previewInterval > 0 {
+			log.Fatalf("VIDEO_URL_MODE %s only signs single files, use %s or set HLS_ENABLED=false, DASH_ENABLED=false and PREVIEW_INTERVAL=0",
+				videoURLMode, urlModeCDNCookie)
+		}
+	}
+
+	gcInterval := time.Duration(0)
+	if interval := os.Getenv("GC_INTERVAL"); interval != "" {
+		gcInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalf("GC_INTERVAL is not a valid duration: %v", err)
+		}
+	}
+
+	gcGracePeriod := 24 * time.Hour
+	if grace := os.Getenv("GC_GRACE_PERIOD"); grace != "" {
+		gcGracePeriod, err = time.ParseDuration(grace)
+		if err != nil {
+			log.Fatalf("GC_GRACE_PERIOD is not a valid duration: %v", err)
+		}
+	}
+	gcDryRun := os.Getenv("GC_DRY_RUN") == "true"
+
+	presignTTL := 15 * time.Minute
+	if ttl := os.Getenv("PRESIGN_TTL"); ttl != "" {
+		presignTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("PRESIGN_TTL is not a valid duration: %v", err)
+		}
+	}
+
 	// Load the AWS credentials from the environment variables
 	// The AWS SDK for Go will automatically look for the credentials in the
 	// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables
@@ -91,6 +265,37 @@ func main() {
 	// Create a new S3 client
 	client := s3.NewFromConfig(config)
 
+	storeOpts := blobStoreOptions{
+		s3Client:   client,
+		s3Bucket:   s3Bucket,
+		s3Region:   s3Region,
+		multipart:  multipart,
+		assetsRoot: assetsRoot,
+		assetsURL:  fmt.Sprintf("http://localhost:%s/assets", port),
+		cdnDomain:  s3CfDistribution,
+		presignTTL: presignTTL,
+
+		cfKeyPairID:      os.Getenv("CF_KEY_PAIR_ID"),
+		cfPrivateKeyPath: os.Getenv("CF_PRIVATE_KEY_PATH"),
+		cfCookieDomain:   os.Getenv("CF_COOKIE_DOMAIN"),
+	}
+	videoStore, err := newBlobStore(videoStorage, storeOpts)
+	if err != nil {
+		log.Fatalf("Couldn't create video storage: %v", err)
+	}
+	thumbnailStore, err := newBlobStore(thumbnailStorage, storeOpts)
+	if err != nil {
+		log.Fatalf("Couldn't create thumbnail storage: %v", err)
+	}
+	videoURLs, err := newURLBuilder(videoURLMode, videoStore, storeOpts)
+	if err != nil {
+		log.Fatalf("Couldn't create video URL builder: %v", err)
+	}
+	thumbnailURLs, err := newURLBuilder(thumbnailURLMode, thumbnailStore, storeOpts)
+	if err != nil {
+		log.Fatalf("Couldn't create thumbnail URL builder: %v", err)
+	}
+
 	cfg := apiConfig{
 		db:               db,
 		jwtSecret:        jwtSecret,
@@ -101,7 +306,39 @@ func main() {
 		s3Region:         s3Region,
 		s3CfDistribution: s3CfDistribution,
 		port:             port,
-		s3Client:         client,
+		videoStore:       videoStore,
+		thumbnailStore:   thumbnailStore,
+		videoURLs:        videoURLs,
+		thumbnailURLs:    thumbnailURLs,
+		tusDir:           tusDir,
+		tusExpiration:    tusExpiration,
+		uploadDir:        uploadDir,
+		scratchMinFree:   scratchMinFree << 20,
+		jobWake:          make(chan struct{}, 1),
+		progress:         newProgressBroker(),
+		hlsEnabled:       hlsEnabled,
+		dashEnabled:      dashEnabled,
+		archiveOriginals: archiveOriginals,
+
+		autoThumbnail:        autoThumbnail,
+		autoThumbnailPercent: thumbnailPercent,
+		previewInterval:      previewInterval,
+
+		media: media,
+	}
+
+	// Direct browser uploads are only possible when videos live in S3
+	if videoStorage == storageBackendS3 {
+		cfg.uploadPresigner = storage.NewUploadPresigner(client, s3Bucket, presignTTL)
+	}
+
+	if len(os.Args) > 1 {
+		switch command := os.Args[1]; command {
+		case "gc":
+			os.Exit(cfg.runGCCommand(os.Args[2:], gcGracePeriod, gcDryRun))
+		default:
+			log.Fatalf("Unknown command %q", command)
+		}
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -109,6 +346,30 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	err = os.MkdirAll(tusDir, 0755)
+	if err != nil {
+		log.Fatalf("Couldn't create tus upload directory: %v", err)
+	}
+	go cfg.runTusExpiration(time.Hour)
+
+	err = os.MkdirAll(uploadDir, 0755)
+	if err != nil {
+		log.Fatalf("Couldn't create upload directory: %v", err)
+	}
+	// Nothing can still be working on scratch files older than a job may run
+	err = cfg.sweepScratch(jobTimeout)
+	if err != nil {
+		log.Printf("Couldn't sweep upload directory: %v", err)
+	}
+	err = cfg.startJobWorkers(context.Background(), jobWorkers)
+	if err != nil {
+		log.Fatalf("Couldn't start job workers: %v", err)
+	}
+
+	if gcInterval > 0 {
+		go cfg.runGarbageCollection(gcInterval, gcGracePeriod, gcDryRun)
+	}
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
@@ -125,8 +386,17 @@ func main() {
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
 	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
 	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/presign", cfg.handlerVideoUploadPresign)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/complete", cfg.handlerVideoUploadComplete)
+
+	mux.HandleFunc("OPTIONS /api/tus/", cfg.handlerTusOptions)
+	mux.HandleFunc("POST /api/tus/videos/{videoID}", cfg.handlerTusCreate)
+	mux.HandleFunc("HEAD /api/tus/{uploadID}", cfg.handlerTusHead)
+	mux.HandleFunc("PATCH /api/tus/{uploadID}", cfg.handlerTusPatch)
+	mux.HandleFunc("DELETE /api/tus/{uploadID}", cfg.handlerTusDelete)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("GET /api/videos/{videoID}/progress", cfg.handlerVideoProgress)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
 
 	/* DEPRECIATED: This is a temporary solution to serve thumbnails from memory.
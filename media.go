@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+/*
+mediaInfo collects the metadata worth keeping from ffprobe's output
+The first video and audio streams describe the file, bitrate falls back
+to the container's when the video stream doesn't report one.
+*/
+func (p FFProbeOutput) mediaInfo(videoID uuid.UUID) database.VideoMedia {
+	media := database.VideoMedia{
+		VideoID:   videoID,
+		Duration:  p.duration().Seconds(),
+		Container: p.Format.FormatName,
+	}
+	media.Bitrate, _ = strconv.ParseInt(p.Format.BitRate, 10, 64)
+
+	if stream, ok := p.videoStream(); ok {
+		media.Width = stream.Width
+		media.Height = stream.Height
+		media.VideoCodec = stream.CodecName
+		media.FrameRate = parseFrameRate(stream.AvgFrameRate)
+		media.Rotation = stream.rotation()
+		if media.Bitrate == 0 {
+			media.Bitrate, _ = strconv.ParseInt(stream.BitRate, 10, 64)
+		}
+	}
+	for _, stream := range p.Streams {
+		if stream.CodecType == "audio" {
+			media.AudioCodec = stream.CodecName
+			media.AudioChannels = stream.Channels
+			break
+		}
+	}
+	return media
+}
+
+/*
+rotation returns how far the stream should be rotated clockwise for display,
+one of 0, 90, 180 or 270. Older ffprobe versions report it as a rotate tag,
+newer ones as a display matrix rotating counterclockwise.
+*/
+func (s Stream) rotation() int {
+	degrees := 0.0
+	if s.Tags.Rotate != "" {
+		degrees, _ = strconv.ParseFloat(s.Tags.Rotate, 64)
+	} else {
+		for _, sideData := range s.SideData {
+			if sideData.SideDataType == "Display Matrix" {
+				degrees = -sideData.Rotation
+				break
+			}
+		}
+	}
+	rotation := int(math.Round(degrees/90)) * 90 % 360
+	if rotation < 0 {
+		rotation += 360
+	}
+	return rotation
+}
+
+// parseFrameRate parses ffprobe's fractional frame rates, e.g. "30000/1001"
+func parseFrameRate(rate string) float64 {
+	num, den, found := strings.Cut(rate, "/")
+	numerator, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return numerator
+	}
+	denominator, err := strconv.ParseFloat(den, 64)
+	if err != nil || denominator == 0 {
+		return 0
+	}
+	return numerator / denominator
+}
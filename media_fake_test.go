@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+fakeMediaProcessor is a scripted MediaProcessor that never runs ffmpeg
+Probe returns the probe scripted for a file, or the default one. Each Run
+call takes the next scripted step, once the script runs out Run copies the
+input file to the output file. Every call is recorded.
+*/
+type fakeMediaProcessor struct {
+	mu           sync.Mutex
+	defaultProbe FFProbeOutput
+	probes       map[string]FFProbeOutput
+	steps        []fakeMediaStep
+	calls        []fakeMediaCall
+}
+
+// fakeMediaStep scripts the outcome of one ffmpeg run
+type fakeMediaStep struct {
+	// Progress is reported in order before the step finishes
+	Progress []time.Duration
+	// Files are written relative to the directory of the output file
+	Files map[string][]byte
+	Err   error
+}
+
+// fakeMediaCall records a Probe, with just the file path, or a Run
+type fakeMediaCall struct {
+	Probe bool
+	Args  []string
+}
+
+func newFakeMediaProcessor(probe FFProbeOutput, steps ...fakeMediaStep) *fakeMediaProcessor {
+	return &fakeMediaProcessor{
+		defaultProbe: probe,
+		probes:       map[string]FFProbeOutput{},
+		steps:        steps,
+	}
+}
+
+// SetProbe scripts the probe returned for filePath
+func (f *fakeMediaProcessor) SetProbe(filePath string, probe FFProbeOutput) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.probes[filePath] = probe
+}
+
+// Calls returns the calls made so far, in order
+func (f *fakeMediaProcessor) Calls() []fakeMediaCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeMediaCall(nil), f.calls...)
+}
+
+// Runs returns the arguments of the Run calls made so far, in order
+func (f *fakeMediaProcessor) Runs() [][]string {
+	runs := [][]string{}
+	for _, call := range f.Calls() {
+		if !call.Probe {
+			runs = append(runs, call.Args)
+		}
+	}
+	return runs
+}
+
+func (f *fakeMediaProcessor) Probe(ctx context.Context, filePath string) (FFProbeOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return FFProbeOutput{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fakeMediaCall{Probe: true, Args: []string{filePath}})
+
+	// ffprobe reads URLs too, only local files can be missing
+	if _, err := os.Stat(filePath); err != nil && !strings.Contains(filePath, "://") {
+		return FFProbeOutput{}, err
+	}
+	if probe, ok := f.probes[filePath]; ok {
+		return probe, nil
+	}
+	return f.defaultProbe, nil
+}
+
+func (f *fakeMediaProcessor) Run(ctx context.Context, args []string, onProgress func(time.Duration)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New("no ffmpeg arguments")
+	}
+
+	f.mu.Lock()
+	f.calls = append(f.calls, fakeMediaCall{Args: append([]string(nil), args...)})
+	var step fakeMediaStep
+	scripted := len(f.steps) > 0
+	if scripted {
+		step, f.steps = f.steps[0], f.steps[1:]
+	}
+	f.mu.Unlock()
+
+	for _, done := range step.Progress {
+		if onProgress != nil {
+			onProgress(done)
+		}
+	}
+	if step.Err != nil {
+		return step.Err
+	}
+
+	output := args[len(args)-1]
+	if !scripted {
+		return copyMediaInput(args, output)
+	}
+	for name, data := range step.Files {
+		err := os.WriteFile(filepath.Join(filepath.Dir(output), name), data, 0o644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyMediaInput copies the -i file of ffmpeg args to output, outputs that
+// are file name patterns such as "segment_%04d.ts" are skipped
+func copyMediaInput(args []string, output string) error {
+	if strings.Contains(output, "%") {
+		return nil
+	}
+	var input string
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-i" {
+			input = args[i+1]
+			break
+		}
+	}
+	if input == "" {
+		return os.WriteFile(output, nil, 0o644)
+	}
+
+	src, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
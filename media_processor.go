@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/*
+MediaProcessor runs the ffprobe and ffmpeg commands of the video pipeline.
+Implementations must stop work and return once ctx is done, so a hung ffmpeg
+can't outlive the request or job that started it.
+*/
+type MediaProcessor interface {
+	// Probe reads the streams and container format of a media file
+	Probe(ctx context.Context, filePath string) (FFProbeOutput, error)
+	// Run runs ffmpeg with args. onProgress, if not nil, is called with
+	// how much of the output has been written.
+	Run(ctx context.Context, args []string, onProgress func(time.Duration)) error
+}
+
+// How long to wait for ffmpeg's output pipes to close after killing it
+const mediaProcessWaitDelay = 5 * time.Second
+
+// execMediaProcessor runs the ffprobe and ffmpeg binaries found on the PATH
+type execMediaProcessor struct{}
+
+func newExecMediaProcessor() (*execMediaProcessor, error) {
+	for _, binary := range []string{"ffprobe", "ffmpeg"} {
+		if _, err := exec.LookPath(binary); err != nil {
+			return nil, fmt.Errorf("%s not found: %w", binary, err)
+		}
+	}
+	return &execMediaProcessor{}, nil
+}
+
+// Probe runs ffprobe and parses its JSON output
+func (execMediaProcessor) Probe(ctx context.Context, filePath string) (FFProbeOutput, error) {
+	cmd := exec.CommandContext(
+		ctx,
+		"ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_streams",
+		"-show_format",
+		filePath,
+	)
+	cmd.WaitDelay = mediaProcessWaitDelay
+	cmd.Stdout = &bytes.Buffer{}
+	cmd.Stderr = &bytes.Buffer{}
+
+	err := cmd.Run()
+	if err != nil {
+		return FFProbeOutput{}, commandError("ffprobe", err, cmd.Stderr.(*bytes.Buffer))
+	}
+
+	var result FFProbeOutput
+	if err := json.Unmarshal(cmd.Stdout.(*bytes.Buffer).Bytes(), &result); err != nil {
+		return FFProbeOutput{}, err
+	}
+	return result, nil
+}
+
+// Run runs ffmpeg, asking it to write progress to stdout. ffmpeg is killed
+// if ctx is done before it exits.
+func (execMediaProcessor) Run(ctx context.Context, args []string, onProgress func(time.Duration)) error {
+	args = append([]string{"-y", "-progress", "pipe:1", "-nostats"}, args...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.WaitDelay = mediaProcessWaitDelay
+	cmd.Stderr = &bytes.Buffer{}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err == nil {
+		readFFmpegProgress(stdout, onProgress)
+		err = cmd.Wait()
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("ffmpeg stopped: %w", ctx.Err())
+	}
+	if err != nil {
+		return commandError("ffmpeg", err, cmd.Stderr.(*bytes.Buffer))
+	}
+	return nil
+}
+
+// commandError adds what a command wrote to stderr to the error it exited
+// with, so job errors and responses say why it failed
+func commandError(name string, err error, stderr *bytes.Buffer) error {
+	msg := strings.TrimSpace(stderr.String())
+	if msg == "" {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return fmt.Errorf("%s: %w: %s", name, err, msg)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCommandError(t *testing.T) {
+	exitErr := errors.New("exit status 1")
+	err := commandError("ffprobe", exitErr, bytes.NewBufferString("clip.mp4: Invalid data found when processing input\n"))
+	if !errors.Is(err, exitErr) {
+		t.Errorf("%v doesn't wrap the exit error", err)
+	}
+	want := "ffprobe: exit status 1: clip.mp4: Invalid data found when processing input"
+	if err.Error() != want {
+		t.Errorf("error = %q, want %q", err, want)
+	}
+
+	err = commandError("ffmpeg", exitErr, &bytes.Buffer{})
+	if err.Error() != "ffmpeg: exit status 1" {
+		t.Errorf("error without stderr = %q", err)
+	}
+}
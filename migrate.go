@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+/*
+runMigrateCommand implements "tubely migrate up|down|status" against the
+database dsn points at. The server applies pending migrations on its own,
+down reverts one migration per run.
+It returns the process exit code.
+*/
+func runMigrateCommand(dsn string, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: tubely migrate up|down|status")
+		return 2
+	}
+
+	db, err := database.Open(dsn)
+	if err != nil {
+		log.Printf("Couldn't connect to database: %v", err)
+		return 1
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		err = db.MigrateUp()
+		if err != nil {
+			log.Printf("Couldn't migrate database: %v", err)
+			return 1
+		}
+		version, err := db.SchemaVersion()
+		if err != nil {
+			log.Printf("Couldn't get schema version: %v", err)
+			return 1
+		}
+		log.Printf("Database is at version %d", version)
+	case "down":
+		reverted, err := db.MigrateDown()
+		if err != nil {
+			log.Printf("Couldn't revert migration: %v", err)
+			return 1
+		}
+		if reverted == nil {
+			log.Println("No migrations to revert")
+			return 0
+		}
+		log.Printf("Reverted migration %d %s", reverted.Version, reverted.Name)
+	case "status":
+		statuses, err := db.MigrateStatus()
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d %-30s %s\n", status.Version, status.Name, applied)
+		}
+		if err != nil {
+			log.Printf("Couldn't get migration status: %v", err)
+			return 1
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command %q, use up, down or status\n", args[0])
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package main
+
+import "math"
+
+// Orientations a video can be classified as, they double as key prefixes
+const (
+	orientationLandscape = "landscape"
+	orientationPortrait  = "portrait"
+	orientationSquare    = "square"
+	orientationUltrawide = "ultrawide"
+	orientationOther     = "other"
+)
+
+const (
+	// How far, relative to the target, a ratio may be off and still match.
+	// Covers encoder padding such as 1920x1088 for 1080p.
+	aspectRatioTolerance = 0.03
+	// Anything at least this wide is ultrawide, e.g. 21:9 and 2.39:1 cinema
+	ultrawideMinRatio = 2.2
+)
+
+// orientation classifies the first video stream of the file
+func (p FFProbeOutput) orientation() string {
+	stream, ok := p.videoStream()
+	if !ok {
+		return orientationOther
+	}
+	return classifyOrientation(stream.Width, stream.Height, stream.rotation())
+}
+
+/*
+classifyOrientation buckets a video by its display aspect ratio
+Videos rotated by 90 or 270 degrees are displayed with width and height
+swapped, so a phone recording stored as 1920x1080 with rotation is portrait.
+Ratios that aren't close to 16:9, 9:16 or 1:1 and aren't ultrawide are other.
+*/
+func classifyOrientation(width, height, rotation int) string {
+	if width <= 0 || height <= 0 {
+		return orientationOther
+	}
+	if rotation == 90 || rotation == 270 {
+		width, height = height, width
+	}
+
+	ratio := float64(width) / float64(height)
+	switch {
+	case ratio >= ultrawideMinRatio:
+		return orientationUltrawide
+	case matchesRatio(ratio, 16.0/9.0):
+		return orientationLandscape
+	case matchesRatio(ratio, 9.0/16.0):
+		return orientationPortrait
+	case matchesRatio(ratio, 1):
+		return orientationSquare
+	}
+	return orientationOther
+}
+
+// matchesRatio reports whether ratio is within aspectRatioTolerance of target
+func matchesRatio(ratio, target float64) bool {
+	return math.Abs(ratio-target)/target <= aspectRatioTolerance
+}
+
+// displaySize returns the stream's size as shown, ffmpeg applies the rotation
+// before any filters so scaling has to use this rather than the coded size
+func (s Stream) displaySize() (int, int) {
+	if rotation := s.rotation(); rotation == 90 || rotation == 270 {
+		return s.Height, s.Width
+	}
+	return s.Width, s.Height
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loadProbe reads ffprobe output recorded in testdata/ffprobe
+func loadProbe(t *testing.T, name string) FFProbeOutput {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "ffprobe", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var probe FFProbeOutput
+	err = json.Unmarshal(data, &probe)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", name, err)
+	}
+	return probe
+}
+
+func TestProbeOrientation(t *testing.T) {
+	tests := []struct {
+		file          string
+		orientation   string
+		rotation      int
+		width, height int
+	}{
+		{"rotate_tag.json", orientationPortrait, 90, 1080, 1920},
+		{"display_matrix_minus90.json", orientationPortrait, 90, 1080, 1920},
+		{"display_matrix_plus90.json", orientationPortrait, 270, 1080, 1920},
+		{"display_matrix_180.json", orientationLandscape, 180, 1920, 1080},
+		{"display_matrix_minus270.json", orientationPortrait, 270, 1080, 1920},
+		{"square.json", orientationSquare, 0, 1080, 1080},
+		{"portrait.json", orientationPortrait, 0, 1080, 1920},
+		{"audio_only.json", orientationOther, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			probe := loadProbe(t, tt.file)
+			if got := probe.orientation(); got != tt.orientation {
+				t.Errorf("orientation = %q, want %q", got, tt.orientation)
+			}
+			stream, _ := probe.videoStream()
+			if got := stream.rotation(); got != tt.rotation {
+				t.Errorf("rotation = %d, want %d", got, tt.rotation)
+			}
+			width, height := stream.displaySize()
+			if width != tt.width || height != tt.height {
+				t.Errorf("displaySize = %dx%d, want %dx%d", width, height, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestClassifyOrientation(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		rotation      int
+		want          string
+	}{
+		{"1080p", 1920, 1080, 0, orientationLandscape},
+		{"encoder padding", 1920, 1088, 0, orientationLandscape},
+		{"rotated 1080p", 1920, 1080, 90, orientationPortrait},
+		{"upside down", 1920, 1080, 180, orientationLandscape},
+		{"cinema", 2390, 1000, 0, orientationUltrawide},
+		{"4:3", 1440, 1080, 0, orientationOther},
+		{"no size", 0, 0, 0, orientationOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyOrientation(tt.width, tt.height, tt.rotation); got != tt.want {
+				t.Errorf("classifyOrientation(%d, %d, %d) = %q, want %q", tt.width, tt.height, tt.rotation, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	previewTrack     = "thumbnails.vtt"
+	previewTrackMIME = "text/vtt"
+	// Width of one preview tile, the height follows the video's aspect ratio
+	previewTileWidth = 160
+	// Each sprite sheet holds previewColumns x previewRows tiles
+	previewColumns = 10
+	previewRows    = 10
+)
+
+/*
+generatePreviewSprites uses ffmpeg to sample a frame every interval and tile
+the frames into JPEG sprite sheets in outputDir. It then writes a WebVTT
+track mapping each interval to its tile, for seek bar previews.
+It returns the name of the WebVTT file or an error if ffmpeg fails.
+*/
+func generatePreviewSprites(ctx context.Context, media MediaProcessor, filePath, outputDir string, probe FFProbeOutput, interval time.Duration) (string, error) {
+	stream, ok := probe.videoStream()
+	displayWidth, displayHeight := stream.displaySize()
+	if !ok || displayWidth == 0 || displayHeight == 0 {
+		return "", fmt.Errorf("no video stream to preview in %s", filePath)
+	}
+	duration := probe.duration()
+	if duration <= 0 {
+		return "", fmt.Errorf("couldn't read the duration of %s", filePath)
+	}
+
+	// Round the tile height to an even number, like ffmpeg's scale=w:-2
+	tileHeight := int(math.Round(float64(previewTileWidth)*float64(displayHeight)/float64(displayWidth)/2)) * 2
+
+	err := media.Run(ctx, []string{
+		"-i", filePath,
+		"-an",
+		"-vf", fmt.Sprintf("fps=1/%g,scale=%d:%d,tile=%dx%d",
+			interval.Seconds(), previewTileWidth, tileHeight, previewColumns, previewRows),
+		"-q:v", "4",
+		filepath.Join(outputDir, "sprite-%03d.jpg"),
+	}, nil)
+	if err != nil {
+		return "", fmt.Errorf("couldn't generate preview sprites: %w", err)
+	}
+
+	track := previewTrackFor(duration, interval, tileHeight)
+	err = os.WriteFile(filepath.Join(outputDir, previewTrack), []byte(track), 0o644)
+	if err != nil {
+		return "", err
+	}
+	return previewTrack, nil
+}
+
+// previewTrackFor writes the WebVTT cues for the sprites generatePreviewSprites makes
+func previewTrackFor(duration, interval time.Duration, tileHeight int) string {
+	var track strings.Builder
+	track.WriteString("WEBVTT\n")
+
+	tilesPerSprite := previewColumns * previewRows
+	for i := 0; time.Duration(i)*interval < duration; i++ {
+		start := time.Duration(i) * interval
+		end := min(start+interval, duration)
+		tile := i % tilesPerSprite
+		fmt.Fprintf(&track, "\n%s --> %s\nsprite-%03d.jpg#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(start), vttTimestamp(end),
+			i/tilesPerSprite+1,
+			tile%previewColumns*previewTileWidth, tile/previewColumns*tileHeight,
+			previewTileWidth, tileHeight,
+		)
+	}
+	return track.String()
+}
+
+// vttTimestamp formats d as a WebVTT timestamp, e.g. "00:01:05.500"
+func vttTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+/*
+processVideoPreview generates the seek bar preview sprites for a video and
+uploads them below keyPrefix/preview, e.g. "landscape/abc123/preview/thumbnails.vtt"
+It returns the key of the WebVTT track.
+*/
+func (cfg *apiConfig) processVideoPreview(ctx context.Context, ws *workspace, video database.Video, filePath string, probe FFProbeOutput, keyPrefix string) (string, error) {
+	outputDir, err := ws.mkdir("preview")
+	if err != nil {
+		return "", err
+	}
+
+	track, err := generatePreviewSprites(ctx, cfg.media, filePath, outputDir, probe, cfg.previewInterval)
+	if err != nil {
+		return "", err
+	}
+
+	prefix := path.Join(keyPrefix, "preview")
+	err = cfg.putDirectory(ctx, outputDir, prefix)
+	if err != nil {
+		return "", fmt.Errorf("couldn't upload preview sprites for video %s: %w", video.ID, err)
+	}
+	return path.Join(prefix, track), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Stages a video goes through between the first uploaded byte and playback
+const (
+	progressStageUpload     = "upload"
+	progressStageProcessing = "processing"
+	progressStageStorage    = "storage"
+	progressStageTranscode  = "transcode"
+	progressStageDone       = "done"
+	progressStageFailed     = "failed"
+)
+
+// progressEvent is sent to the browser as the data of a Server-Sent Event
+type progressEvent struct {
+	Stage   string  `json:"stage"`
+	Bytes   int64   `json:"bytes,omitempty"`
+	Total   int64   `json:"total,omitempty"`
+	Percent float64 `json:"percent"`
+	Message string  `json:"message,omitempty"`
+}
+
+func (e progressEvent) final() bool {
+	return e.Stage == progressStageDone || e.Stage == progressStageFailed
+}
+
+/*
+progressBroker fans out progress events per video to any number of
+subscribers. It remembers the latest event so a subscriber that connects
+half way through gets the current state straight away.
+Progress is only tracked in memory, for the process doing the work.
+*/
+type progressBroker struct {
+	mu          sync.Mutex
+	latest      map[uuid.UUID]progressEvent
+	subscribers map[uuid.UUID]map[chan progressEvent]struct{}
+}
+
+func newProgressBroker() *progressBroker {
+	return &progressBroker{
+		latest:      map[uuid.UUID]progressEvent{},
+		subscribers: map[uuid.UUID]map[chan progressEvent]struct{}{},
+	}
+}
+
+/*
+publish sends an event to the subscribers of a video. Slow subscribers miss
+intermediate events rather than block the pipeline, but a final event always
+arrives: it takes the place of the oldest buffered event if it has to, and
+the channels are closed after it.
+*/
+func (b *progressBroker) publish(videoID uuid.UUID, event progressEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !event.final() {
+		b.latest[videoID] = event
+		for ch := range b.subscribers[videoID] {
+			select {
+			case ch <- event:
+			default:
+			}
+		}
+		return
+	}
+
+	delete(b.latest, videoID)
+	for ch := range b.subscribers[videoID] {
+		select {
+		case ch <- event:
+		default:
+			// Only publish sends, so after dropping one event there's room
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- event
+		}
+		close(ch)
+	}
+	delete(b.subscribers, videoID)
+}
+
+// subscribe returns a channel of events for a video and a function that
+// must be called to stop receiving them. The channel is closed after the
+// video's final event.
+func (b *progressBroker) subscribe(videoID uuid.UUID) (<-chan progressEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan progressEvent, 16)
+	if b.subscribers[videoID] == nil {
+		b.subscribers[videoID] = map[chan progressEvent]struct{}{}
+	}
+	b.subscribers[videoID][ch] = struct{}{}
+	if event, ok := b.latest[videoID]; ok {
+		ch <- event
+	}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers[videoID], ch)
+		if len(b.subscribers[videoID]) == 0 {
+			delete(b.subscribers, videoID)
+		}
+	}
+}
+
+// progressReader publishes how many bytes have been read from r, at most
+// every 250ms
+type progressReader struct {
+	r        io.Reader
+	read     int64
+	total    int64
+	report   func(read, total int64)
+	reported time.Time
+}
+
+func newProgressReader(r io.Reader, total int64, report func(read, total int64)) *progressReader {
+	return &progressReader{
+		r:      r,
+		total:  total,
+		report: report,
+	}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if time.Since(p.reported) > 250*time.Millisecond || err == io.EOF {
+		p.reported = time.Now()
+		p.report(p.read, p.total)
+	}
+	return n, err
+}
+
+func (p *progressReader) Close() error {
+	if closer, ok := p.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// byteProgress builds the event for bytes out of total bytes moved in a stage
+func byteProgress(stage string, bytes, total int64) progressEvent {
+	event := progressEvent{
+		Stage: stage,
+		Bytes: bytes,
+		Total: total,
+	}
+	if total > 0 {
+		event.Percent = min(100, float64(bytes)*100/float64(total))
+	}
+	return event
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestProgressBrokerDeliversFinalEvent(t *testing.T) {
+	broker := newProgressBroker()
+	videoID := uuid.New()
+	events, unsubscribe := broker.subscribe(videoID)
+	defer unsubscribe()
+
+	// Fill the buffer well past its size, like a subscriber that stopped reading
+	for i := 0; i < 100; i++ {
+		broker.publish(videoID, progressEvent{Stage: progressStageTranscode, Percent: float64(i)})
+	}
+	broker.publish(videoID, progressEvent{Stage: progressStageDone, Percent: 100})
+
+	var last progressEvent
+	received := 0
+	for event := range events {
+		last = event
+		received++
+	}
+	if !last.final() || last.Stage != progressStageDone {
+		t.Errorf("last event = %+v, want done", last)
+	}
+	if received > 16 {
+		t.Errorf("received %d events, more than the buffer holds", received)
+	}
+
+	// A late subscriber gets no stale state and isn't closed by anyone
+	late, unsubscribeLate := broker.subscribe(videoID)
+	defer unsubscribeLate()
+	select {
+	case event := <-late:
+		t.Errorf("late subscriber got %+v", event)
+	default:
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// Ways of picking a poster frame, selectable with AUTO_THUMBNAIL
+const (
+	autoThumbnailOff     = "off"
+	autoThumbnailPercent = "percent"
+	autoThumbnailScene   = "scene"
+)
+
+// Frames that differ from the previous one by more than this count as a
+// scene change, see the ffmpeg select filter
+const sceneChangeThreshold = 0.4
+
+// Widths of the thumbnail variants, all cropped to 16:9. Sizes wider than
+// the upload are skipped so nothing gets upscaled.
+var thumbnailWidths = []int{1280, 640, 320}
+
+// thumbnailSet is a stored thumbnail, Key is the largest JPEG for clients
+// that only read thumbnail_url
+type thumbnailSet struct {
+	Key      string
+	Variants database.ThumbnailVariants
+}
+
+/*
+storeThumbnail turns an uploaded or generated image into the thumbnail
+variants and puts them in the thumbnail store below a new random prefix,
+e.g. "abc123/640.webp". The image is rotated upright as its EXIF data says,
+cropped to 16:9 and re-encoded, which drops the metadata. Intermediate files
+go in ws. Decoding errors are reported as errInvalidMedia.
+*/
+func (cfg *apiConfig) storeThumbnail(ctx context.Context, ws *workspace, data []byte) (thumbnailSet, error) {
+	// Check the declared size before decoding allocates memory for it
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return thumbnailSet{}, fmt.Errorf("%w: %v", errInvalidMedia, err)
+	}
+	err = checkImageSize(config)
+	if err != nil {
+		return thumbnailSet{}, err
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return thumbnailSet{}, fmt.Errorf("%w: %v", errInvalidMedia, err)
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+	img = cropToAspect(img, 16, 9)
+
+	dir, err := os.MkdirTemp(ws.dir, "thumbnail-*")
+	if err != nil {
+		return thumbnailSet{}, err
+	}
+	sourcePath := filepath.Join(dir, "source.png")
+	err = writePNG(sourcePath, img)
+	if err != nil {
+		return thumbnailSet{}, err
+	}
+
+	prefix, err := randomAssetKey("", "")
+	if err != nil {
+		return thumbnailSet{}, err
+	}
+	set := thumbnailSet{Variants: database.ThumbnailVariants{
+		"webp": {},
+		"jpeg": {},
+	}}
+	for _, width := range thumbnailSizesFor(img.Bounds().Dx()) {
+		height := max(2, width*9/16/2*2)
+		scale := fmt.Sprintf("scale=%d:%d:flags=lanczos", width, height)
+		descriptor := fmt.Sprintf("%dw", width)
+
+		for _, variant := range []struct {
+			format      string
+			contentType string
+			args        []string
+		}{
+			{"jpeg", "image/jpeg", []string{"-q:v", "3"}},
+			{"webp", "image/webp", []string{"-c:v", "libwebp", "-quality", "80"}},
+		} {
+			name := fmt.Sprintf("%d.%s", width, strings.TrimPrefix(variant.contentType, "image/"))
+			outputPath := filepath.Join(dir, name)
+			args := append([]string{"-i", sourcePath, "-vf", scale}, variant.args...)
+			err = cfg.media.Run(ctx, append(args, outputPath), nil)
+			if err != nil {
+				cfg.deleteThumbnail(ctx, set.Variants)
+				return thumbnailSet{}, fmt.Errorf("couldn't encode %s thumbnail: %w", name, err)
+			}
+
+			key := path.Join(prefix, name)
+			err = cfg.putFile(ctx, cfg.thumbnailStore, outputPath, key, variant.contentType)
+			if err != nil {
+				cfg.deleteThumbnail(ctx, set.Variants)
+				return thumbnailSet{}, fmt.Errorf("couldn't save thumbnail: %w", err)
+			}
+			set.Variants[variant.format][descriptor] = key
+			if set.Key == "" && variant.format == "jpeg" {
+				set.Key = key
+			}
+		}
+	}
+	return set, nil
+}
+
+// thumbnailSizesFor returns the variant widths for an image width pixels wide
+func thumbnailSizesFor(width int) []int {
+	sizes := []int{}
+	for _, w := range thumbnailWidths {
+		if w <= width {
+			sizes = append(sizes, w)
+		}
+	}
+	if len(sizes) == 0 {
+		// Smaller than the smallest size, keep it as it is
+		sizes = append(sizes, max(2, width/2*2))
+	}
+	return sizes
+}
+
+// deleteThumbnail removes every variant of a thumbnail from the thumbnail store
+func (cfg *apiConfig) deleteThumbnail(ctx context.Context, variants database.ThumbnailVariants) {
+	for _, sizes := range variants {
+		for _, key := range sizes {
+			err := cfg.thumbnailStore.Delete(ctx, key)
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				log.Printf("Couldn't delete thumbnail %s: %v", key, err)
+			}
+		}
+	}
+}
+
+func writePNG(filePath string, img image.Image) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	err = encoder.Encode(file, img)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// putFile puts a local file in store under key
+func (cfg *apiConfig) putFile(ctx context.Context, store storage.BlobStore, filePath, key, contentType string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return store.Put(ctx, key, file, contentType)
+}
+
+/*
+generateThumbnail extracts a poster frame from a video and stores it like an
+uploaded thumbnail. In scene mode the first frame after a scene change is
+used, falling back to the percentage pick when ffmpeg finds none.
+It returns the stored thumbnail.
+*/
+func (cfg *apiConfig) generateThumbnail(ctx context.Context, ws *workspace, filePath string, probe FFProbeOutput) (thumbnailSet, error) {
+	outputDir, err := ws.mkdir("poster")
+	if err != nil {
+		return thumbnailSet{}, err
+	}
+	posterPath := filepath.Join(outputDir, "poster.jpg")
+
+	extracted := false
+	if cfg.autoThumbnail == autoThumbnailScene {
+		err = extractSceneChangeFrame(ctx, cfg.media, filePath, posterPath)
+		if err != nil {
+			return thumbnailSet{}, err
+		}
+		_, err = os.Stat(posterPath)
+		extracted = err == nil
+	}
+	if !extracted {
+		offset := probe.duration() * time.Duration(cfg.autoThumbnailPercent) / 100
+		err = extractFrameAt(ctx, cfg.media, filePath, posterPath, offset.Seconds())
+		if err != nil {
+			return thumbnailSet{}, err
+		}
+	}
+
+	poster, err := os.ReadFile(posterPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return thumbnailSet{}, errors.New("ffmpeg didn't extract a poster frame")
+	}
+	if err != nil {
+		return thumbnailSet{}, err
+	}
+
+	return cfg.storeThumbnail(ctx, ws, poster)
+}
+
+// extractFrameAt uses ffmpeg to save the frame at offset seconds as a JPEG
+func extractFrameAt(ctx context.Context, media MediaProcessor, filePath, outputPath string, offset float64) error {
+	return media.Run(ctx, []string{
+		"-ss", fmt.Sprintf("%.3f", offset),
+		"-i", filePath,
+		"-frames:v", "1",
+		"-q:v", "2",
+		outputPath,
+	}, nil)
+}
+
+// extractSceneChangeFrame uses ffmpeg to save the first frame after a scene
+// change as a JPEG. No file is written if the video has no scene changes.
+func extractSceneChangeFrame(ctx context.Context, media MediaProcessor, filePath, outputPath string) error {
+	return media.Run(ctx, []string{
+		"-i", filePath,
+		"-vf", fmt.Sprintf("select='gt(scene,%.2f)'", sceneChangeThreshold),
+		"-frames:v", "1",
+		"-fps_mode", "vfr",
+		"-q:v", "2",
+		outputPath,
+	}, nil)
+}
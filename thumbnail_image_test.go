@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestApplyOrientation(t *testing.T) {
+	// A 3x2 image whose pixels are numbered row by row:
+	//   0 1 2
+	//   3 4 5
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := 0; i < 6; i++ {
+		src.Set(i%3, i/3, color.NRGBA{R: uint8(i), A: 255})
+	}
+
+	tests := []struct {
+		orientation int
+		want        [][]uint8
+	}{
+		{1, [][]uint8{{0, 1, 2}, {3, 4, 5}}},
+		{2, [][]uint8{{2, 1, 0}, {5, 4, 3}}},
+		{3, [][]uint8{{5, 4, 3}, {2, 1, 0}}},
+		{4, [][]uint8{{3, 4, 5}, {0, 1, 2}}},
+		{5, [][]uint8{{0, 3}, {1, 4}, {2, 5}}},
+		{6, [][]uint8{{3, 0}, {4, 1}, {5, 2}}},
+		{7, [][]uint8{{5, 2}, {4, 1}, {3, 0}}},
+		{8, [][]uint8{{2, 5}, {1, 4}, {0, 3}}},
+	}
+	for _, tt := range tests {
+		got := applyOrientation(src, tt.orientation)
+		b := got.Bounds()
+		if b.Dx() != len(tt.want[0]) || b.Dy() != len(tt.want) {
+			t.Errorf("orientation %d: size %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), len(tt.want[0]), len(tt.want))
+			continue
+		}
+		for y, row := range tt.want {
+			for x, want := range row {
+				r, _, _, _ := got.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				if uint8(r>>8) != want {
+					t.Errorf("orientation %d: pixel (%d, %d) = %d, want %d", tt.orientation, x, y, r>>8, want)
+				}
+			}
+		}
+	}
+
+	// Sub-images of RGBA images are read from their own origin
+	rgba := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	rgba.Set(2, 1, color.RGBA{R: 9, A: 255})
+	got := applyOrientation(rgba.SubImage(image.Rect(1, 1, 4, 3)), 3)
+	if r, _, _, _ := got.At(1, 1).RGBA(); r>>8 != 9 {
+		t.Errorf("sub-image pixel = %d, want 9", r>>8)
+	}
+}
+
+// pngWithSize encodes a 1x1 PNG, then rewrites its header to declare a
+// width x height image, as a decompression bomb would
+func pngWithSize(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// Signature, IHDR length and type, then the width and height
+	ihdr := data[12 : 12+4+13]
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	binary.BigEndian.PutUint32(data[12+4+13:], crc32.ChecksumIEEE(ihdr))
+	return data
+}
+
+func TestValidateImageSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height uint32
+		valid         bool
+	}{
+		{"small", 1, 1, true},
+		{"8192x4096", 8192, 4096, true},
+		{"60000x60000", 60000, 60000, false},
+		{"one very long side", 1 << 30, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validateImage(bytes.NewReader(pngWithSize(t, tt.width, tt.height)))
+			if tt.valid && err != nil {
+				t.Errorf("validateImage error = %v", err)
+			}
+			if !tt.valid && !errors.Is(err, errInvalidMedia) {
+				t.Errorf("validateImage error = %v, want errInvalidMedia", err)
+			}
+		})
+	}
+}
+
+func TestStoreThumbnailRejectsHugeImage(t *testing.T) {
+	media := newFakeMediaProcessor(testProbe)
+	cfg := newTestConfig(t, media)
+	ws, err := cfg.newWorkspace(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	_, err = cfg.storeThumbnail(context.Background(), ws, pngWithSize(t, 60000, 60000))
+	if !errors.Is(err, errInvalidMedia) {
+		t.Errorf("storeThumbnail error = %v, want errInvalidMedia", err)
+	}
+	if len(media.Calls()) != 0 {
+		t.Errorf("calls = %v, want none", media.Calls())
+	}
+}
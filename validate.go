@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"os"
+)
+
+// How many leading bytes are read to sniff a file's type
+const sniffLen = 512
+
+// maxImagePixels caps the size of images that get decoded. A small file can
+// declare a huge image, and decoding allocates memory for every pixel.
+const maxImagePixels = 40_000_000
+
+// videoFormats are the video types accepted for upload, with the file
+// extension used for them. Processing normalizes all of them to MP4.
+var videoFormats = map[string]string{
+	"video/mp4":        "mp4",
+	"video/quicktime":  "mov",
+	"video/webm":       "webm",
+	"video/x-matroska": "mkv",
+}
+
+var (
+	// errUnsupportedMedia means the file's contents aren't of an accepted type
+	errUnsupportedMedia = errors.New("unsupported media type")
+	// errInvalidMedia means the file looks right but can't be decoded
+	errInvalidMedia = errors.New("invalid media")
+)
+
+/*
+sniffMediaType identifies a file from its leading bytes, ignoring whatever
+type the client claimed. It returns "" for anything it doesn't recognize.
+*/
+func sniffMediaType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return "image/jpeg"
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(head, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		// Matroska and WebM share the EBML header, its DocType tells them apart
+		if bytes.Contains(head, []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		// ISO base media files start with an ftyp box naming the brand
+		if string(head[8:12]) == "qt  " {
+			return "video/quicktime"
+		}
+		return "video/mp4"
+	}
+	return ""
+}
+
+// sniffReader reads the head of r to sniff its type, then seeks back to the start
+func sniffReader(r io.ReadSeeker) (string, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	return sniffMediaType(head[:n]), nil
+}
+
+// checkImageSize returns errInvalidMedia unless an image's header declares
+// a size that is safe to decode
+func checkImageSize(config image.Config) error {
+	if config.Width <= 0 || config.Height <= 0 {
+		return fmt.Errorf("%w: image has no size", errInvalidMedia)
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return fmt.Errorf("%w: image is %dx%d, more than %d megapixels",
+			errInvalidMedia, config.Width, config.Height, maxImagePixels/1_000_000)
+	}
+	return nil
+}
+
+/*
+validateImage checks that r holds a JPEG or PNG image whose header decodes
+to a size no larger than maxImagePixels
+It returns the sniffed content type, errUnsupportedMedia or errInvalidMedia.
+r is rewound to the start.
+*/
+func validateImage(r io.ReadSeeker) (string, error) {
+	contentType, err := sniffReader(r)
+	if err != nil {
+		return "", err
+	}
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		return "", fmt.Errorf("%w: expected a JPEG or PNG image", errUnsupportedMedia)
+	}
+
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidMedia, err)
+	}
+	err = checkImageSize(config)
+	if err != nil {
+		return "", err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	return contentType, nil
+}
+
+/*
+validateVideoFile checks that the file at filePath is in one of the accepted
+video formats and has a video stream ffprobe can read, with a size and a
+duration.
+It returns the sniffed content type, or errUnsupportedMedia or
+errInvalidMedia describing the problem.
+*/
+func (cfg *apiConfig) validateVideoFile(ctx context.Context, filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	contentType, err := sniffReader(file)
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+	if _, ok := videoFormats[contentType]; !ok {
+		return "", fmt.Errorf("%w: expected an MP4, MOV, WebM or MKV video", errUnsupportedMedia)
+	}
+
+	err = cfg.probeVideo(ctx, filePath)
+	if err != nil {
+		return "", err
+	}
+	return contentType, nil
+}
+
+/*
+probeVideo checks that ffprobe can read a video stream with a size and a
+duration from source, a file path or a URL ffprobe can fetch.
+It returns errInvalidMedia describing the problem.
+*/
+func (cfg *apiConfig) probeVideo(ctx context.Context, source string) error {
+	probe, err := cfg.media.Probe(ctx, source)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: %w", errInvalidMedia, err)
+	}
+	stream, ok := probe.videoStream()
+	if !ok || stream.CodecName == "" {
+		return fmt.Errorf("%w: no video stream", errInvalidMedia)
+	}
+	if stream.Width <= 0 || stream.Height <= 0 {
+		return fmt.Errorf("%w: video stream has no size", errInvalidMedia)
+	}
+	if probe.duration() <= 0 {
+		return fmt.Errorf("%w: video has no duration", errInvalidMedia)
+	}
+	return nil
+}
+
+// mediaErrorStatus returns the HTTP status for an error from the validators
+func mediaErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, errUnsupportedMedia):
+		return http.StatusUnsupportedMediaType, "Unsupported media type"
+	case errors.Is(err, errInvalidMedia):
+		return http.StatusUnprocessableEntity, "Invalid media file"
+	}
+	return http.StatusInternalServerError, "Couldn't validate file"
+}
+
+// sniffStoredObject reads the head of an object in the video store to sniff its type
+func (cfg *apiConfig) sniffStoredObject(ctx context.Context, key string) (string, error) {
+	body, err := cfg.videoStore.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(body, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return sniffMediaType(head[:n]), nil
+}
@@ -1,90 +1,139 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Structs to unmarshal the ffprobe output
 type Stream struct {
-	AspectRatio string `json:"display_aspect_ratio"`
+	CodecType    string     `json:"codec_type"`
+	CodecName    string     `json:"codec_name"`
+	Width        int        `json:"width"`
+	Height       int        `json:"height"`
+	BitRate      string     `json:"bit_rate"`
+	AvgFrameRate string     `json:"avg_frame_rate"`
+	Channels     int        `json:"channels"`
+	Tags         StreamTags `json:"tags"`
+	SideData     []SideData `json:"side_data_list"`
+}
+type StreamTags struct {
+	Rotate string `json:"rotate"`
+}
+type SideData struct {
+	SideDataType string  `json:"side_data_type"`
+	Rotation     float64 `json:"rotation"`
+}
+type Format struct {
+	FormatName string `json:"format_name"`
+	Duration   string `json:"duration"`
+	BitRate    string `json:"bit_rate"`
 }
 type FFProbeOutput struct {
 	Streams []Stream `json:"streams"`
+	Format  Format   `json:"format"`
 }
 
-/*
-getVideoAspectRatio uses ffprobe to get the aspect ratio of a video file
-It returns the aspect ratio as a string (e.g., "16:9", "9:16") or an error if it fails
-to execute ffprobe or parse the output.
-*/
-func getVideoAspectRatio(filePath string) (string, error) {
-	// Use ffprobe to get the video aspect ratio
-
-	cmd := exec.Command(
-		"ffprobe",
-		"-v", "error",
-		"-print_format", "json",
-		"-show_streams",
-		filePath,
-	)
-	cmd.Stdout = &bytes.Buffer{}
-	cmd.Stderr = &bytes.Buffer{}
-
-	err := cmd.Run()
+// duration returns how long the video is, or zero if ffprobe doesn't know
+func (p FFProbeOutput) duration() time.Duration {
+	seconds, err := strconv.ParseFloat(p.Format.Duration, 64)
 	if err != nil {
-		fmt.Println("ffprobe error:", err)
-		fmt.Println("ffprobe stderr:", cmd.Stderr.(*bytes.Buffer).String())
-		return "", err
+		return 0
 	}
+	return time.Duration(seconds * float64(time.Second))
+}
 
-	// Unmarshal the output to get the aspect ratio
-	output := cmd.Stdout.(*bytes.Buffer).Bytes()
-
-	var result FFProbeOutput
-	if err := json.Unmarshal(output, &result); err != nil {
-		return "", err
+// videoStream returns the first video stream, ffprobe may list audio first
+func (p FFProbeOutput) videoStream() (Stream, bool) {
+	for _, stream := range p.Streams {
+		if stream.CodecType == "video" {
+			return stream, true
+		}
 	}
-	if len(result.Streams) == 0 {
-		return "", nil
-	}
-	return result.Streams[0].AspectRatio, nil
+	return Stream{}, false
 }
 
 /*
-processVideoForFastStart uses ffmpeg to process a video file for fast start
-It copies the video stream and sets the movflags to faststart
-It returns the path to the processed video file or an error if it fails
+normalizeVideo uses ffmpeg to turn a video into a fast start H.264/AAC MP4
+at outputFilePath. Streams that are already H.264 or AAC are copied, the
+rest are transcoded, so an MP4 from a phone is only remuxed.
+onProgress, if not nil, is called with how much of the video has been written
+It returns an error if it fails
 */
-func processVideoForFastStart(filePath string) (string, error) {
+func normalizeVideo(ctx context.Context, media MediaProcessor, filePath, outputFilePath string, probe FFProbeOutput, onProgress func(time.Duration)) error {
+	args := []string{"-i", filePath, "-map", "0:v:0", "-map", "0:a:0?"}
 
-	outputFilePath := filePath + ".processing"
+	stream, _ := probe.videoStream()
+	if stream.CodecName == "h264" {
+		args = append(args, "-c:v", "copy")
+	} else {
+		args = append(args,
+			"-c:v", "libx264",
+			"-preset", "veryfast",
+			"-crf", "20",
+			"-pix_fmt", "yuv420p",
+		)
+	}
+	if probe.audioCodec() == "aac" {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args, "-c:a", "aac", "-b:a", "160k")
+	}
 
-	// Use ffmpeg to process the video for fast start
-	cmd := exec.Command(
-		"ffmpeg",
-		"-i", filePath,
-		"-c", "copy",
+	// Use ffmpeg to write the MP4 with the moov atom first for fast start
+	err := media.Run(ctx, append(args,
 		"-movflags", "faststart",
 		"-f", "mp4",
 		outputFilePath,
-	)
-	cmd.Stdout = &bytes.Buffer{}
-	cmd.Stderr = &bytes.Buffer{}
-
-	err := cmd.Run()
+	), onProgress)
 	if err != nil {
-		fmt.Println("ffprobe error:", err)
-		fmt.Println("ffprobe stderr:", cmd.Stderr.(*bytes.Buffer).String())
-		return "", err
+		return err
 	}
 	// Check if the output file was created
 	if _, err := os.Stat(outputFilePath); err != nil {
 		fmt.Println("Output file stat error:", err)
-		return "", err
+		return err
+	}
+	return nil
+}
+
+// audioCodec returns the codec of the first audio stream, or "" if there's none
+func (p FFProbeOutput) audioCodec() string {
+	for _, stream := range p.Streams {
+		if stream.CodecType == "audio" {
+			return stream.CodecName
+		}
+	}
+	return ""
+}
+
+/*
+readFFmpegProgress reads the key=value lines ffmpeg writes with -progress
+and reports the out_time of each block until r is exhausted
+*/
+func readFFmpegProgress(r io.Reader, onProgress func(time.Duration)) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || onProgress == nil {
+			continue
+		}
+		// out_time_ms is in microseconds too, older ffmpeg builds only have that one
+		if key != "out_time_us" && key != "out_time_ms" {
+			continue
+		}
+		microseconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		onProgress(time.Duration(microseconds) * time.Microsecond)
 	}
-	return outputFilePath, nil
+	// Keep draining so ffmpeg never blocks on a full pipe
+	io.Copy(io.Discard, r)
 }
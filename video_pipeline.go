@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+/*
+processVideoUpload runs an uploaded video file through the processing pipeline
+It buckets the video by orientation, normalizes it to an MP4, puts the
+result in the video store and saves the new key on the video's row, marking
+it as ready. Videos without a thumbnail get a poster frame and every video
+gets a seek bar preview track.
+Intermediate files are written to ws.
+It returns the updated video or an error if any step fails.
+*/
+func (cfg *apiConfig) processVideoUpload(ctx context.Context, ws *workspace, video database.Video, filePath string) (database.Video, error) {
+	// Probe the video for its size, rotation and duration
+	probe, err := cfg.media.Probe(ctx, filePath)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't probe video: %w", err)
+	}
+	// Keys are grouped by orientation, e.g. "landscape/abc123.mp4"
+	subdirectory := probe.orientation()
+
+	// Normalize the video to a fast start H.264/AAC MP4, reporting how far ffmpeg got
+	duration := probe.duration()
+	cfg.progress.publish(video.ID, progressEvent{Stage: progressStageProcessing})
+	processedFilePath := ws.path("processed.mp4")
+	err = normalizeVideo(ctx, cfg.media, filePath, processedFilePath, probe, func(done time.Duration) {
+		cfg.progress.publish(video.ID, byteProgress(progressStageProcessing, int64(done), int64(duration)))
+	})
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't normalize video: %w", err)
+	}
+	// The MP4 is what gets published, describe that rather than the upload
+	processedProbe, err := cfg.media.Probe(ctx, processedFilePath)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't probe normalized video: %w", err)
+	}
+
+	// open the processed file
+	processedFile, err := os.Open(processedFilePath)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't open processed file: %w", err)
+	}
+	defer processedFile.Close()
+	processedInfo, err := processedFile.Stat()
+	if err != nil {
+		return database.Video{}, err
+	}
+
+	// Generate a unique key below the orientation subdirectory
+	videoKey, err := randomAssetKey(subdirectory, "mp4")
+	if err != nil {
+		return database.Video{}, err
+	}
+
+	// A retry stores its files under a new key, so until the row points at
+	// this attempt's files they're deleted if it fails
+	var poster thumbnailSet
+	videoID := video.ID
+	published := false
+	defer func() {
+		if published {
+			return
+		}
+		attempt := videoAssets(database.Video{VideoURL: &videoKey}).
+			merge(thumbnailAssets(database.Video{Thumbnails: poster.Variants}))
+		err := cfg.scheduleAssetDeletion(videoID, attempt)
+		if err != nil {
+			log.Printf("Couldn't schedule deleting files of failed attempt at video %s: %v", videoID, err)
+		}
+	}()
+
+	// Put the file in the video store, reporting how much has been sent
+	body := newProgressReader(processedFile, processedInfo.Size(), func(read, total int64) {
+		cfg.progress.publish(video.ID, byteProgress(progressStageStorage, read, total))
+	})
+	err = cfg.videoStore.Put(ctx, videoKey, body, "video/mp4")
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't upload video: %w", err)
+	}
+
+	// Transcode an adaptive bitrate ladder next to the MP4. CMAF packaging
+	// serves the same segments to both HLS and DASH players.
+	outputs := database.VideoOutputs{database.VideoOutputMP4}
+	var manifestKey, dashManifestKey *string
+	keyPrefix := strings.TrimSuffix(videoKey, path.Ext(videoKey))
+
+	// Keep the file as it was uploaded next to the MP4
+	var originalKey *string
+	if cfg.archiveOriginals {
+		key, err := cfg.archiveOriginal(ctx, filePath, keyPrefix)
+		if err != nil {
+			return database.Video{}, err
+		}
+		originalKey = &key
+	}
+
+	if cfg.dashEnabled {
+		mpdKey, playlistKey, err := cfg.processVideoCMAF(ctx, ws, video, filePath, probe, keyPrefix)
+		if err != nil {
+			return database.Video{}, err
+		}
+		manifestKey, dashManifestKey = &playlistKey, &mpdKey
+		outputs = append(outputs, database.VideoOutputHLS, database.VideoOutputDASH)
+	} else if cfg.hlsEnabled {
+		key, err := cfg.processVideoHLS(ctx, ws, video, filePath, probe, keyPrefix)
+		if err != nil {
+			return database.Video{}, err
+		}
+		manifestKey = &key
+		outputs = append(outputs, database.VideoOutputHLS)
+	}
+
+	// Sprite sheets and a WebVTT track for seek bar previews, a video
+	// without them still plays so a failure here isn't fatal
+	var previewTrackKey *string
+	if cfg.previewInterval > 0 {
+		key, err := cfg.processVideoPreview(ctx, ws, video, processedFilePath, probe, keyPrefix)
+		if err != nil {
+			log.Printf("Couldn't generate preview track for video %s: %v", video.ID, err)
+		} else {
+			previewTrackKey = &key
+		}
+	}
+
+	// Pick a poster frame when the user hasn't uploaded a thumbnail
+	if video.ThumbnailURL == nil && cfg.autoThumbnail != autoThumbnailOff {
+		poster, err = cfg.generateThumbnail(ctx, ws, filePath, probe)
+		if err != nil {
+			log.Printf("Couldn't generate thumbnail for video %s: %v", video.ID, err)
+		}
+	}
+
+	// Reload the video, it may have changed while we were processing
+	video, err = cfg.db.GetVideo(videoID)
+	if err != nil {
+		return database.Video{}, err
+	}
+	if video.ID == uuid.Nil {
+		// The video was deleted meanwhile, nothing references the new files
+		return database.Video{}, nil
+	}
+
+	// A thumbnail uploaded in the meantime wins over the generated one
+	if poster.Key != "" {
+		if video.ThumbnailURL == nil {
+			video.ThumbnailURL = &poster.Key
+			video.Thumbnails = poster.Variants
+		} else {
+			cfg.deleteThumbnail(ctx, poster.Variants)
+		}
+	}
+
+	// Keep what ffprobe found so listings can filter on it
+	err = cfg.db.UpsertVideoMedia(processedProbe.mediaInfo(video.ID))
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't save media metadata: %w", err)
+	}
+
+	// Update the video metadata in the database, only the key is stored.
+	// The files of an earlier upload are deleted once the row points here.
+	replaced := videoAssets(video)
+	video.VideoURL = &videoKey
+	video.ManifestURL = manifestKey
+	video.DashManifestURL = dashManifestKey
+	video.PreviewTrackURL = previewTrackKey
+	video.OriginalURL = originalKey
+	video.Outputs = outputs
+	video.Status = database.VideoStatusReady
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't update video: %w", err)
+	}
+	published = true
+	err = cfg.scheduleAssetDeletion(video.ID, replaced)
+	if err != nil {
+		log.Printf("Couldn't schedule deleting replaced files of video %s: %v", video.ID, err)
+	}
+	cfg.progress.publish(video.ID, progressEvent{Stage: progressStageDone, Percent: 100})
+	return video, nil
+}
+
+/*
+processVideoHLS transcodes the HLS ladder for a video and uploads it below
+keyPrefix/hls, e.g. "landscape/abc123/hls/master.m3u8"
+It returns the key of the master playlist.
+*/
+func (cfg *apiConfig) processVideoHLS(ctx context.Context, ws *workspace, video database.Video, filePath string, probe FFProbeOutput, keyPrefix string) (string, error) {
+	outputDir, err := ws.mkdir("hls")
+	if err != nil {
+		return "", err
+	}
+
+	cfg.progress.publish(video.ID, progressEvent{Stage: progressStageTranscode})
+	masterPlaylist, err := transcodeHLS(ctx, cfg.media, filePath, outputDir, probe, func(done float64) {
+		cfg.progress.publish(video.ID, progressEvent{Stage: progressStageTranscode, Percent: done * 100})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	prefix := path.Join(keyPrefix, "hls")
+	err = cfg.putDirectory(ctx, outputDir, prefix)
+	if err != nil {
+		return "", fmt.Errorf("couldn't upload HLS ladder: %w", err)
+	}
+	return path.Join(prefix, masterPlaylist), nil
+}
+
+/*
+archiveOriginal puts the uploaded file in the video store as it arrived,
+e.g. "landscape/abc123/original.mov"
+It returns the key of the archived file.
+*/
+func (cfg *apiConfig) archiveOriginal(ctx context.Context, filePath, keyPrefix string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	contentType, err := sniffReader(file)
+	if err != nil {
+		return "", err
+	}
+	extension, ok := videoFormats[contentType]
+	if !ok {
+		contentType, extension = "application/octet-stream", "bin"
+	}
+
+	key := path.Join(keyPrefix, "original."+extension)
+	err = cfg.videoStore.Put(ctx, key, file, contentType)
+	if err != nil {
+		return "", fmt.Errorf("couldn't archive original upload: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// testProbe describes a 10 second 1080p H.264 MP4 with stereo AAC audio
+var testProbe = FFProbeOutput{
+	Streams: []Stream{
+		{CodecType: "video", CodecName: "h264", Width: 1920, Height: 1080, AvgFrameRate: "30/1", BitRate: "4500000"},
+		{CodecType: "audio", CodecName: "aac", Channels: 2, BitRate: "128000"},
+	},
+	Format: Format{FormatName: "mov,mp4,m4a,3gp,3g2,mj2", Duration: "10.000000", BitRate: "4628000"},
+}
+
+// newTestConfig returns a config with an SQLite database, in-memory stores
+// and media, and the pipeline's optional steps turned off
+func newTestConfig(t *testing.T, media MediaProcessor) *apiConfig {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := database.NewClient(filepath.Join(dir, "tubely.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	uploadDir := filepath.Join(dir, "uploads")
+	err = os.Mkdir(uploadDir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &apiConfig{
+		db:             db,
+		jwtSecret:      "test-secret",
+		videoStore:     storage.NewMemoryStore("http://localhost/videos"),
+		thumbnailStore: storage.NewMemoryStore("http://localhost/thumbnails"),
+		uploadDir:      uploadDir,
+		jobWake:        make(chan struct{}, 1),
+		progress:       newProgressBroker(),
+		autoThumbnail:  autoThumbnailOff,
+		media:          media,
+	}
+}
+
+// newTestVideo creates a user and a video of theirs
+func newTestVideo(t *testing.T, cfg *apiConfig) database.Video {
+	t.Helper()
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: "owner@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
+
+// writeTestFile writes a file with some content and returns its path
+func writeTestFile(t *testing.T, dir, name string) string {
+	t.Helper()
+	filePath := filepath.Join(dir, name)
+	err := os.WriteFile(filePath, []byte("not really a video"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+// argAfter returns the argument following flag, or "" if flag isn't there
+func argAfter(args []string, flag string) string {
+	i := slices.Index(args, flag)
+	if i < 0 || i+1 >= len(args) {
+		return ""
+	}
+	return args[i+1]
+}
+
+func TestNormalizeVideo(t *testing.T) {
+	hevc := FFProbeOutput{Streams: []Stream{
+		{CodecType: "video", CodecName: "hevc", Width: 1920, Height: 1080},
+		{CodecType: "audio", CodecName: "opus", Channels: 2},
+	}}
+	tests := []struct {
+		name         string
+		probe        FFProbeOutput
+		video, audio string
+	}{
+		{"h264 and aac are copied", testProbe, "copy", "copy"},
+		{"other codecs are transcoded", hevc, "libx264", "aac"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			input := writeTestFile(t, dir, "upload.mov")
+			output := filepath.Join(dir, "processed.mp4")
+			media := newFakeMediaProcessor(tt.probe, fakeMediaStep{
+				Progress: []time.Duration{2 * time.Second, 10 * time.Second},
+				Files:    map[string][]byte{"processed.mp4": []byte("mp4")},
+			})
+
+			var progress []time.Duration
+			err := normalizeVideo(context.Background(), media, input, output, tt.probe, func(done time.Duration) {
+				progress = append(progress, done)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			runs := media.Runs()
+			if len(runs) != 1 {
+				t.Fatalf("ffmpeg ran %d times, want once", len(runs))
+			}
+			args := runs[0]
+			if argAfter(args, "-i") != input || args[len(args)-1] != output {
+				t.Errorf("args = %v, want %s in and %s out", args, input, output)
+			}
+			if got := argAfter(args, "-c:v"); got != tt.video {
+				t.Errorf("-c:v = %q, want %q", got, tt.video)
+			}
+			if got := argAfter(args, "-c:a"); got != tt.audio {
+				t.Errorf("-c:a = %q, want %q", got, tt.audio)
+			}
+			if argAfter(args, "-movflags") != "faststart" {
+				t.Errorf("args = %v, want faststart", args)
+			}
+			if !slices.Equal(progress, []time.Duration{2 * time.Second, 10 * time.Second}) {
+				t.Errorf("progress = %v", progress)
+			}
+		})
+	}
+
+	t.Run("ffmpeg fails", func(t *testing.T) {
+		dir := t.TempDir()
+		input := writeTestFile(t, dir, "upload.mov")
+		failure := errors.New("exit status 1")
+		media := newFakeMediaProcessor(testProbe, fakeMediaStep{Err: failure})
+		err := normalizeVideo(context.Background(), media, input, filepath.Join(dir, "processed.mp4"), testProbe, nil)
+		if !errors.Is(err, failure) {
+			t.Errorf("error = %v, want %v", err, failure)
+		}
+	})
+
+	t.Run("no output written", func(t *testing.T) {
+		dir := t.TempDir()
+		input := writeTestFile(t, dir, "upload.mov")
+		media := newFakeMediaProcessor(testProbe, fakeMediaStep{})
+		err := normalizeVideo(context.Background(), media, input, filepath.Join(dir, "processed.mp4"), testProbe, nil)
+		if err == nil {
+			t.Error("normalizing succeeded without an output file")
+		}
+	})
+}
+
+func TestTranscodeHLS(t *testing.T) {
+	dir := t.TempDir()
+	input := writeTestFile(t, dir, "processed.mp4")
+	outputDir := filepath.Join(dir, "hls")
+	err := os.Mkdir(outputDir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A 720p source gets the 720p, 480p and 360p rungs
+	probe := testProbe
+	probe.Streams = []Stream{{CodecType: "video", CodecName: "h264", Width: 1280, Height: 720, AvgFrameRate: "30/1"}}
+	steps := []fakeMediaStep{}
+	for _, name := range []string{"720p", "480p", "360p"} {
+		steps = append(steps, fakeMediaStep{
+			Progress: []time.Duration{5 * time.Second, 10 * time.Second},
+			Files: map[string][]byte{
+				name + ".m3u8":    []byte("#EXTM3U\n"),
+				name + "_0000.ts": []byte("ts"),
+			},
+		})
+	}
+	media := newFakeMediaProcessor(probe, steps...)
+
+	var progress []float64
+	master, err := transcodeHLS(context.Background(), media, input, outputDir, probe, func(done float64) {
+		progress = append(progress, done)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if master != hlsMasterPlaylist {
+		t.Errorf("master = %q, want %q", master, hlsMasterPlaylist)
+	}
+
+	runs := media.Runs()
+	want := []struct{ scale, level, playlist string }{
+		{"scale=1280:720", "3.1", "720p.m3u8"},
+		{"scale=854:480", "3.1", "480p.m3u8"},
+		{"scale=640:360", "3.0", "360p.m3u8"},
+	}
+	if len(runs) != len(want) {
+		t.Fatalf("ffmpeg ran %d times, want %d", len(runs), len(want))
+	}
+	for i, args := range runs {
+		if got := argAfter(args, "-vf"); got != want[i].scale {
+			t.Errorf("run %d -vf = %q, want %q", i, got, want[i].scale)
+		}
+		if got := argAfter(args, "-level:v"); got != want[i].level {
+			t.Errorf("run %d -level:v = %q, want %q", i, got, want[i].level)
+		}
+		if got := args[len(args)-1]; got != filepath.Join(outputDir, want[i].playlist) {
+			t.Errorf("run %d writes %q", i, got)
+		}
+	}
+
+	// Progress covers the whole ladder, one third per rung
+	if len(progress) != 6 || progress[1] != 1.0/3 || progress[5] != 1 {
+		t.Errorf("progress = %v", progress)
+	}
+
+	data, err := os.ReadFile(filepath.Join(outputDir, hlsMasterPlaylist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist := string(data)
+	for _, want := range []string{"720p.m3u8", "480p.m3u8", "360p.m3u8", `CODECS="avc1.4d401f"`} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("master playlist is missing %s:\n%s", want, playlist)
+		}
+	}
+	if strings.Contains(playlist, "1080p") || strings.Contains(playlist, "mp4a") {
+		t.Errorf("master playlist lists a rung or codec the source doesn't have:\n%s", playlist)
+	}
+}
+
+func TestTranscodeHLSFailure(t *testing.T) {
+	dir := t.TempDir()
+	input := writeTestFile(t, dir, "processed.mp4")
+	failure := errors.New("exit status 1")
+	media := newFakeMediaProcessor(testProbe, fakeMediaStep{}, fakeMediaStep{Err: failure})
+
+	_, err := transcodeHLS(context.Background(), media, input, dir, testProbe, nil)
+	if !errors.Is(err, failure) {
+		t.Errorf("error = %v, want %v", err, failure)
+	}
+	if len(media.Runs()) != 2 {
+		t.Errorf("ffmpeg ran %d times, want to stop after the failing rung", len(media.Runs()))
+	}
+	if _, err := os.Stat(filepath.Join(dir, hlsMasterPlaylist)); err == nil {
+		t.Error("master playlist was written for a failed ladder")
+	}
+}
+
+func TestPackageCMAF(t *testing.T) {
+	tests := []struct {
+		name           string
+		probe          FFProbeOutput
+		adaptationSets string
+		maps           int
+	}{
+		{"with audio", testProbe, "id=0,streams=v id=1,streams=a", 5},
+		{"without audio", FFProbeOutput{
+			Streams: testProbe.Streams[:1],
+			Format:  testProbe.Format,
+		}, "id=0,streams=v", 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			input := writeTestFile(t, dir, "processed.mp4")
+			media := newFakeMediaProcessor(tt.probe, fakeMediaStep{
+				Progress: []time.Duration{5 * time.Second, 20 * time.Second},
+				Files: map[string][]byte{
+					dashManifest:    []byte("<MPD/>"),
+					cmafHLSPlaylist: []byte("#EXTM3U\n"),
+				},
+			})
+
+			var progress []float64
+			mpd, playlist, err := packageCMAF(context.Background(), media, input, dir, tt.probe, func(done float64) {
+				progress = append(progress, done)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mpd != dashManifest || playlist != cmafHLSPlaylist {
+				t.Errorf("packageCMAF = %q, %q", mpd, playlist)
+			}
+
+			runs := media.Runs()
+			if len(runs) != 1 {
+				t.Fatalf("ffmpeg ran %d times, want once", len(runs))
+			}
+			args := runs[0]
+			maps := 0
+			for _, arg := range args {
+				if arg == "-map" {
+					maps++
+				}
+			}
+			if maps != tt.maps {
+				t.Errorf("%d -map arguments, want %d", maps, tt.maps)
+			}
+			if got := argAfter(args, "-adaptation_sets"); got != tt.adaptationSets {
+				t.Errorf("-adaptation_sets = %q, want %q", got, tt.adaptationSets)
+			}
+			if argAfter(args, "-level:v:0") != "4.0" || argAfter(args, "-level:v:3") != "3.0" {
+				t.Errorf("args = %v, want levels 4.0 to 3.0", args)
+			}
+			if got := args[len(args)-1]; got != filepath.Join(dir, dashManifest) {
+				t.Errorf("output = %q", got)
+			}
+			// Progress is capped at the end of the video
+			if !slices.Equal(progress, []float64{0.5, 1}) {
+				t.Errorf("progress = %v", progress)
+			}
+		})
+	}
+}
+
+func TestProcessVideoUpload(t *testing.T) {
+	media := newFakeMediaProcessor(testProbe)
+	cfg := newTestConfig(t, media)
+	cfg.hlsEnabled = true
+	video := newTestVideo(t, cfg)
+
+	ws, err := cfg.newWorkspace(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	source := writeTestFile(t, ws.dir, "source.mov")
+
+	events, unsubscribe := cfg.progress.subscribe(video.ID)
+	defer unsubscribe()
+
+	processed, err := cfg.processVideoUpload(context.Background(), ws, video, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Probe the upload, normalize it, probe the result, then one run per rung
+	calls := media.Calls()
+	if len(calls) != 3+len(hlsLadder) {
+		t.Fatalf("calls = %v", calls)
+	}
+	if !calls[0].Probe || calls[0].Args[0] != source {
+		t.Errorf("first call = %+v, want a probe of the upload", calls[0])
+	}
+	if calls[1].Probe || argAfter(calls[1].Args, "-i") != source || calls[1].Args[len(calls[1].Args)-1] != ws.path("processed.mp4") {
+		t.Errorf("second call = %+v, want normalizing the upload", calls[1])
+	}
+	if !calls[2].Probe || calls[2].Args[0] != ws.path("processed.mp4") {
+		t.Errorf("third call = %+v, want a probe of the normalized file", calls[2])
+	}
+	for _, call := range calls[3:] {
+		if call.Probe || argAfter(call.Args, "-f") != "hls" || argAfter(call.Args, "-i") != source {
+			t.Errorf("call = %+v, want an HLS rung", call)
+		}
+	}
+
+	if processed.Status != database.VideoStatusReady {
+		t.Errorf("status = %q, want %q", processed.Status, database.VideoStatusReady)
+	}
+	if processed.VideoURL == nil || !strings.HasPrefix(*processed.VideoURL, "landscape/") || !strings.HasSuffix(*processed.VideoURL, ".mp4") {
+		t.Fatalf("video key = %v, want landscape/*.mp4", processed.VideoURL)
+	}
+	keyPrefix := strings.TrimSuffix(*processed.VideoURL, ".mp4")
+	if processed.ManifestURL == nil || *processed.ManifestURL != keyPrefix+"/hls/master.m3u8" {
+		t.Errorf("manifest key = %v", processed.ManifestURL)
+	}
+	if !slices.Equal(processed.Outputs, database.VideoOutputs{database.VideoOutputMP4, database.VideoOutputHLS}) {
+		t.Errorf("outputs = %v", processed.Outputs)
+	}
+
+	// The stored MP4 is the normalized file, which the fake copied from the upload
+	ctx := context.Background()
+	for _, key := range []string{*processed.VideoURL, *processed.ManifestURL, keyPrefix + "/hls/1080p.m3u8", keyPrefix + "/hls/360p.m3u8"} {
+		if _, err := cfg.videoStore.Stat(ctx, key); err != nil {
+			t.Errorf("%s isn't stored: %v", key, err)
+		}
+	}
+	info, _ := cfg.videoStore.Stat(ctx, *processed.VideoURL)
+	if info.ContentType != "video/mp4" || info.Size != int64(len("not really a video")) {
+		t.Errorf("stored video = %+v", info)
+	}
+
+	saved, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != database.VideoStatusReady || saved.VideoURL == nil || *saved.VideoURL != *processed.VideoURL {
+		t.Errorf("saved video = %+v", saved)
+	}
+	mediaInfo, err := cfg.db.GetVideoMedia(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaInfo.Width != 1920 || mediaInfo.Height != 1080 || mediaInfo.VideoCodec != "h264" || mediaInfo.Duration != 10 {
+		t.Errorf("media info = %+v", mediaInfo)
+	}
+
+	var last progressEvent
+	for event := range events {
+		last = event
+	}
+	if last.Stage != progressStageDone {
+		t.Errorf("last progress event = %+v, want done", last)
+	}
+}
+
+func TestProcessVideoUploadFailure(t *testing.T) {
+	failure := errors.New("exit status 1")
+	media := newFakeMediaProcessor(testProbe, fakeMediaStep{Err: failure})
+	cfg := newTestConfig(t, media)
+	video := newTestVideo(t, cfg)
+
+	ws, err := cfg.newWorkspace(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	source := writeTestFile(t, ws.dir, "source.mov")
+
+	_, err = cfg.processVideoUpload(context.Background(), ws, video, source)
+	if !errors.Is(err, failure) {
+		t.Fatalf("error = %v, want %v", err, failure)
+	}
+	if len(media.Calls()) != 2 {
+		t.Errorf("calls = %v, want a probe and the failed normalize", media.Calls())
+	}
+	objects, err := cfg.videoStore.List(context.Background(), "")
+	if err != nil || len(objects) != 0 {
+		t.Errorf("stored objects = %v, %v, want none", objects, err)
+	}
+	saved, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.VideoURL != nil {
+		t.Errorf("video key = %q after a failed run", *saved.VideoURL)
+	}
+}
+
+// A step failing after the MP4 is stored leaves nothing behind, a retry
+// stores its files under a new key
+func TestProcessVideoUploadFailureRemovesStoredFiles(t *testing.T) {
+	failure := errors.New("exit status 1")
+	media := newFakeMediaProcessor(testProbe,
+		fakeMediaStep{Files: map[string][]byte{"processed.mp4": mp4Head}},
+		fakeMediaStep{Err: failure},
+	)
+	cfg := newTestConfig(t, media)
+	cfg.hlsEnabled = true
+	cfg.archiveOriginals = true
+	video := newTestVideo(t, cfg)
+
+	ws, err := cfg.newWorkspace(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	source := writeTestFile(t, ws.dir, "source.mov")
+
+	ctx := context.Background()
+	_, err = cfg.processVideoUpload(ctx, ws, video, source)
+	if !errors.Is(err, failure) {
+		t.Fatalf("error = %v, want %v", err, failure)
+	}
+	stored, err := cfg.videoStore.List(ctx, "")
+	if err != nil || len(stored) != 2 {
+		t.Fatalf("stored objects = %v, %v, want the MP4 and the original", stored, err)
+	}
+
+	job, err := cfg.db.ClaimJob(time.Now().UTC())
+	if err != nil || job == nil || job.Kind != jobKindDeleteAssets {
+		t.Fatalf("ClaimJob = %+v, %v, want a delete_assets job", job, err)
+	}
+	cfg.runJob(ctx, *job)
+	left, err := cfg.videoStore.List(ctx, "")
+	if err != nil || len(left) != 0 {
+		t.Errorf("objects left = %v, %v, want none", left, err)
+	}
+}
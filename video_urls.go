@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+/*
+videoWithURLs converts the storage keys saved on a video into the URLs
+clients should fetch them from, using the configured URL builders.
+Signed URLs are generated here on every response and never stored.
+Rows written before keys were stored still hold full URLs, those are
+returned unchanged.
+*/
+func (cfg *apiConfig) videoWithURLs(ctx context.Context, video database.Video) (database.Video, error) {
+	var err error
+	video.ThumbnailURL, err = resolveAssetURL(ctx, cfg.thumbnailURLs, video.ThumbnailURL)
+	if err != nil {
+		return database.Video{}, err
+	}
+	video.Thumbnails, err = resolveThumbnailURLs(ctx, cfg.thumbnailURLs, video.Thumbnails)
+	if err != nil {
+		return database.Video{}, err
+	}
+	video.VideoURL, err = resolveAssetURL(ctx, cfg.videoURLs, video.VideoURL)
+	if err != nil {
+		return database.Video{}, err
+	}
+	video.ManifestURL, err = resolveAssetURL(ctx, cfg.videoURLs, video.ManifestURL)
+	if err != nil {
+		return database.Video{}, err
+	}
+	video.DashManifestURL, err = resolveAssetURL(ctx, cfg.videoURLs, video.DashManifestURL)
+	if err != nil {
+		return database.Video{}, err
+	}
+	video.PreviewTrackURL, err = resolveAssetURL(ctx, cfg.videoURLs, video.PreviewTrackURL)
+	if err != nil {
+		return database.Video{}, err
+	}
+	video.OriginalURL, err = resolveAssetURL(ctx, cfg.videoURLs, video.OriginalURL)
+	if err != nil {
+		return database.Video{}, err
+	}
+	return video, nil
+}
+
+/*
+setVideoCookies sets the signed cookies that grant access to a video's files
+when the video URL builder authorizes with cookies instead of signed URLs
+*/
+func (cfg *apiConfig) setVideoCookies(w http.ResponseWriter, video database.Video) error {
+	signer, ok := cfg.videoURLs.(cookieSigner)
+	if !ok || video.VideoURL == nil || isAbsoluteURL(*video.VideoURL) {
+		return nil
+	}
+	cookies, err := signer.SignedCookies(*video.VideoURL)
+	if err != nil {
+		return err
+	}
+	for _, cookie := range cookies {
+		http.SetCookie(w, cookie)
+	}
+	return nil
+}
+
+// cookieSigner is implemented by URL builders that grant access with cookies
+type cookieSigner interface {
+	SignedCookies(key string) ([]*http.Cookie, error)
+}
+
+func (cfg *apiConfig) videosWithURLs(ctx context.Context, videos []database.Video) ([]database.Video, error) {
+	resolved := make([]database.Video, 0, len(videos))
+	for _, video := range videos {
+		video, err := cfg.videoWithURLs(ctx, video)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, video)
+	}
+	return resolved, nil
+}
+
+func resolveAssetURL(ctx context.Context, urls storage.URLBuilder, key *string) (*string, error) {
+	if key == nil || *key == "" {
+		return key, nil
+	}
+	if isAbsoluteURL(*key) {
+		return key, nil
+	}
+	url, err := urls.BuildURL(ctx, *key)
+	if err != nil {
+		return nil, err
+	}
+	return &url, nil
+}
+
+// resolveThumbnailURLs returns a copy of variants with URLs in place of keys
+func resolveThumbnailURLs(ctx context.Context, urls storage.URLBuilder, variants database.ThumbnailVariants) (database.ThumbnailVariants, error) {
+	if len(variants) == 0 {
+		return variants, nil
+	}
+	resolved := make(database.ThumbnailVariants, len(variants))
+	for format, sizes := range variants {
+		resolved[format] = make(map[string]string, len(sizes))
+		for descriptor, key := range sizes {
+			url, err := resolveAssetURL(ctx, urls, &key)
+			if err != nil {
+				return nil, err
+			}
+			resolved[format][descriptor] = *url
+		}
+	}
+	return resolved, nil
+}
+
+func isAbsoluteURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
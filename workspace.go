@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	workspacePattern = "tubely-work-*"
+	uploadPattern    = "tubely-upload-*"
+	// Processing writes the faststart copy plus the HLS or CMAF ladder next
+	// to the source, reserve room for a few copies of it
+	workspaceSizeFactor = 3
+)
+
+// errScratchFull is returned when the scratch disk is too full to take more work
+var errScratchFull = errors.New("not enough free space for scratch files")
+
+/*
+workspace is a scratch directory below the upload directory that holds every
+intermediate file of one processing run. Close removes it with everything in
+it, so callers defer Close right after creating one.
+*/
+type workspace struct {
+	dir string
+}
+
+// newWorkspace creates a workspace after checking there's room for reserve more bytes
+func (cfg *apiConfig) newWorkspace(reserve int64) (*workspace, error) {
+	err := cfg.checkScratchSpace(reserve)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(cfg.uploadDir, workspacePattern)
+	if err != nil {
+		return nil, err
+	}
+	return &workspace{dir: dir}, nil
+}
+
+// path returns the path of a file in the workspace
+func (w *workspace) path(name string) string {
+	return filepath.Join(w.dir, name)
+}
+
+// mkdir creates a directory in the workspace and returns its path
+func (w *workspace) mkdir(name string) (string, error) {
+	dir := w.path(name)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Close removes the workspace and everything in it
+func (w *workspace) Close() error {
+	return os.RemoveAll(w.dir)
+}
+
+/*
+checkScratchSpace returns errScratchFull if writing need more bytes to the
+upload directory would leave less than the configured minimum free. The
+check is skipped on platforms where free space can't be read.
+*/
+func (cfg *apiConfig) checkScratchSpace(need int64) error {
+	if cfg.scratchMinFree <= 0 {
+		return nil
+	}
+	free, err := diskFree(cfg.uploadDir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't read free disk space: %w", err)
+	}
+	if need < 0 {
+		need = 0
+	}
+	if free < uint64(need)+uint64(cfg.scratchMinFree) {
+		return fmt.Errorf("%w: %d MB free", errScratchFull, free>>20)
+	}
+	return nil
+}
+
+// scratchCheckInterval is how many bytes a scratchWriter writes between
+// free space checks
+const scratchCheckInterval = 64 << 20
+
+/*
+scratchWriter writes to a file in the upload directory and checks the free
+space again every scratchCheckInterval bytes, so a write whose size wasn't
+known up front fails with errScratchFull before the disk fills up.
+*/
+type scratchWriter struct {
+	cfg       *apiConfig
+	w         io.Writer
+	unchecked int64
+}
+
+func (cfg *apiConfig) newScratchWriter(w io.Writer) *scratchWriter {
+	// Check before the first write
+	return &scratchWriter{cfg: cfg, w: w, unchecked: scratchCheckInterval}
+}
+
+func (s *scratchWriter) Write(p []byte) (int, error) {
+	if s.unchecked+int64(len(p)) > scratchCheckInterval {
+		err := s.cfg.checkScratchSpace(max(int64(len(p)), scratchCheckInterval))
+		if err != nil {
+			return 0, err
+		}
+		s.unchecked = 0
+	}
+	n, err := s.w.Write(p)
+	s.unchecked += int64(n)
+	return n, err
+}
+
+/*
+sweepScratch removes files a crashed process left in the upload directory.
+Uploads still referenced by a queued or running job are kept, anything else
+last modified before maxAge ago is removed.
+*/
+func (cfg *apiConfig) sweepScratch(maxAge time.Duration) error {
+	jobs, err := cfg.db.GetUnfinishedJobs(jobKindProcessVideo)
+	if err != nil {
+		return err
+	}
+	pending := map[string]bool{}
+	for _, job := range jobs {
+		var payload processVideoPayload
+		if json.Unmarshal([]byte(job.Payload), &payload) == nil && payload.SourcePath != "" {
+			pending[filepath.Clean(payload.SourcePath)] = true
+		}
+	}
+
+	entries, err := os.ReadDir(cfg.uploadDir)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "tubely-") {
+			continue
+		}
+		name := filepath.Join(cfg.uploadDir, entry.Name())
+		if pending[filepath.Clean(name)] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		err = os.RemoveAll(name)
+		if err != nil {
+			log.Printf("Couldn't remove stale scratch file %s: %v", name, err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Removed %d stale scratch files from %s", removed, cfg.uploadDir)
+	}
+	return nil
+}
+
+// sourceSize returns the size of a job's source, local or staged
+func (cfg *apiConfig) sourceSize(ctx context.Context, payload processVideoPayload) (int64, error) {
+	if payload.StagingKey != "" {
+		info, err := cfg.videoStore.Stat(ctx, payload.StagingKey)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size, nil
+	}
+	info, err := os.Stat(payload.SourcePath)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}